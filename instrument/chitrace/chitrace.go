@@ -0,0 +1,37 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+// Package chitrace instruments the routers of github.com/go-chi/chi/v5.
+package chitrace
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jonbodner/orchestrion/instrument"
+	ddchi "gopkg.in/DataDog/dd-trace-go.v1/contrib/go-chi/chi.v5"
+)
+
+// WrapRouter adds the tracing middleware of the target to r. The target is
+// the one set when the request is served, as routers built before main calls
+// instrument.Init, e.g. in package variables, would get the default target otherwise.
+func WrapRouter(r *chi.Mux) *chi.Mux {
+	r.Use(middleware())
+	return r
+}
+
+func middleware() func(http.Handler) http.Handler {
+	dd := ddchi.Middleware()
+	return func(next http.Handler) http.Handler {
+		ddNext, genericNext := dd(next), instrument.Middleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if instrument.Target() == instrument.DD {
+				ddNext.ServeHTTP(w, r)
+				return
+			}
+			genericNext.ServeHTTP(w, r)
+		})
+	}
+}
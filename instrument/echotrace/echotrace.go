@@ -0,0 +1,33 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+// Package echotrace instruments the routers of github.com/labstack/echo/v4.
+package echotrace
+
+import (
+	"github.com/jonbodner/orchestrion/instrument"
+	"github.com/labstack/echo/v4"
+	ddecho "gopkg.in/DataDog/dd-trace-go.v1/contrib/labstack/echo.v4"
+)
+
+// WrapRouter adds the tracing middleware of the target to e. The target is
+// the one set when the request is served, see chitrace.WrapRouter.
+func WrapRouter(e *echo.Echo) *echo.Echo {
+	e.Use(middleware())
+	return e
+}
+
+func middleware() echo.MiddlewareFunc {
+	dd, generic := ddecho.Middleware(), echo.WrapMiddleware(instrument.Middleware)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		ddNext, genericNext := dd(next), generic(next)
+		return func(c echo.Context) error {
+			if instrument.Target() == instrument.DD {
+				return ddNext(c)
+			}
+			return genericNext(c)
+		}
+	}
+}
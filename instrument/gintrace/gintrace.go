@@ -0,0 +1,38 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+// Package gintrace instruments the engines of github.com/gin-gonic/gin.
+package gintrace
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jonbodner/orchestrion/instrument"
+	ddgin "gopkg.in/DataDog/dd-trace-go.v1/contrib/gin-gonic/gin"
+)
+
+// WrapRouter adds the tracing middleware of the target to e. The target is
+// the one set when the request is served, see chitrace.WrapRouter.
+func WrapRouter(e *gin.Engine) *gin.Engine {
+	e.Use(middleware())
+	return e
+}
+
+func middleware() gin.HandlerFunc {
+	dd := ddgin.Middleware("")
+	return func(c *gin.Context) {
+		if instrument.Target() == instrument.DD {
+			dd(c)
+			return
+		}
+		// the rest of the chain is served by the instrumented handler,
+		// with the request holding the context of its span
+		instrument.Middleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			c.Request = r
+			c.Next()
+		})).ServeHTTP(c.Writer, c.Request)
+	}
+}
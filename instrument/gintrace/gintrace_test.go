@@ -0,0 +1,44 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package gintrace
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jonbodner/orchestrion/instrument"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+)
+
+func TestWrapRouter(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	defer instrument.SetInstrumenter(instrument.Target())
+	gin.SetMode(gin.TestMode)
+
+	// the router is wrapped before the target is set, e.g. in a package variable
+	instrument.SetInstrumenter(instrument.DD)
+	e := WrapRouter(gin.New())
+	served := 0
+	e.GET("/orders/:id", func(c *gin.Context) {
+		served++
+		c.Status(http.StatusOK)
+	})
+
+	instrument.SetInstrumenter(instrument.Console)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/orders/1", nil))
+	require.Empty(t, mt.FinishedSpans())
+
+	instrument.SetInstrumenter(instrument.DD)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/orders/1", nil))
+	spans := mt.FinishedSpans()
+	require.Len(t, spans, 1)
+	require.Equal(t, "GET /orders/:id", spans[0].Tag("resource.name"))
+	require.Equal(t, 2, served)
+}
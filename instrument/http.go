@@ -0,0 +1,61 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package instrument
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The functions below replace the methods of http.Client, and the functions of net/http
+// using http.DefaultClient, in report mode. They report the requests as calls.
+// A nil client stands for http.DefaultClient.
+
+// HTTPDo is client.Do.
+func HTTPDo(client *http.Client, req *http.Request) (*http.Response, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ctx := Report(req.Context(), EventCall, "name", req.URL, "verb", req.Method)
+	defer Report(ctx, EventReturn, "name", req.URL, "verb", req.Method)
+	return client.Do(InsertHeader(req.WithContext(ctx)))
+}
+
+// HTTPGet is client.Get, with the context ctx.
+func HTTPGet(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return HTTPDo(client, req)
+}
+
+// HTTPHead is client.Head, with the context ctx.
+func HTTPHead(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return HTTPDo(client, req)
+}
+
+// HTTPPost is client.Post, with the context ctx.
+func HTTPPost(ctx context.Context, client *http.Client, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return HTTPDo(client, req)
+}
+
+// HTTPPostForm is client.PostForm, with the context ctx.
+func HTTPPostForm(ctx context.Context, client *http.Client, url string, data url.Values) (*http.Response, error) {
+	return HTTPPost(ctx, client, url, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
+}
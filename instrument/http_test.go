@@ -0,0 +1,120 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package instrument
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+)
+
+func TestHTTPClient(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		io.Copy(w, r.Body)
+	}))
+	defer srv.Close()
+
+	ctx := Report(context.Background(), EventStart, "function-name", "TestHTTPClient")
+	for _, tt := range []struct {
+		name        string
+		do          func() (*http.Response, error)
+		method      string
+		contentType string
+		body        string
+	}{
+		{
+			name:   "get",
+			do:     func() (*http.Response, error) { return HTTPGet(ctx, nil, srv.URL) },
+			method: http.MethodGet,
+		},
+		{
+			name:   "head",
+			do:     func() (*http.Response, error) { return HTTPHead(ctx, srv.Client(), srv.URL) },
+			method: http.MethodHead,
+		},
+		{
+			name: "post",
+			do: func() (*http.Response, error) {
+				return HTTPPost(ctx, nil, srv.URL, "text/plain", strings.NewReader("hello"))
+			},
+			method:      http.MethodPost,
+			contentType: "text/plain",
+			body:        "hello",
+		},
+		{
+			name:        "post form",
+			do:          func() (*http.Response, error) { return HTTPPostForm(ctx, nil, srv.URL, url.Values{"a": {"b"}}) },
+			method:      http.MethodPost,
+			contentType: "application/x-www-form-urlencoded",
+			body:        "a=b",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.do()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			if got.Method != tt.method {
+				t.Errorf("Expected method %s, but got %s", tt.method, got.Method)
+			}
+			if ct := got.Header.Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Expected content type %q, but got %q", tt.contentType, ct)
+			}
+			if string(b) != tt.body {
+				t.Errorf("Expected body %q, but got %q", tt.body, b)
+			}
+			if got.Header.Get("X-Datadog-Trace-Id") == "" {
+				t.Errorf("Expected the trace to be propagated")
+			}
+		})
+	}
+	if spans := mt.FinishedSpans(); len(spans) != 4 {
+		t.Errorf("Expected 4 spans, but got %d", len(spans))
+	}
+}
+
+func TestMiddlewareSetInstrumenter(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	defer SetInstrumenter(Target())
+
+	var served atomic.Int32
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+	}))
+	// the target may change while the requests are served
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+		go func(i int) {
+			defer wg.Done()
+			SetInstrumenter([]Key{DD, Console}[i%2])
+		}(i)
+	}
+	wg.Wait()
+	if n := served.Load(); n != 10 {
+		t.Errorf("Expected 10 requests served, but got %d", n)
+	}
+}
@@ -9,12 +9,16 @@ import (
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"fmt"
 	"github.com/jonbodner/orchestrion/instrument/event"
 	"github.com/jonbodner/orchestrion/internal/support"
 	"google.golang.org/grpc"
 	sqltrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/database/sql"
 	grpctrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/google.golang.org/grpc"
 	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 )
 
 // if a function meets the handlerfunc type, insert code to:
@@ -77,12 +81,12 @@ Once we have this working for these simple cases, can work on harder ones!
 */
 
 type Instrumenter interface {
-	Init() func()
+	Init(service string) func()
 	InsertHeader(r *http.Request) *http.Request
 	Report(ctx context.Context, e event.Event, metadata ...any) context.Context
-	WrapHandlerFunc(handlerFunc http.HandlerFunc) http.HandlerFunc
+	WrapHandlerFunc(handlerFunc http.HandlerFunc, pattern string) http.HandlerFunc
 	WrapHTTPClient(client *http.Client) *http.Client
-	WrapHandler(handler http.Handler) http.Handler
+	WrapHandler(handler http.Handler, pattern string) http.Handler
 }
 
 type Key string
@@ -99,38 +103,108 @@ var instrumenters = map[Key]Instrumenter{
 	OTel:    &support.OTelInstrumenter{},
 }
 
-var instrumenter = instrumenters[DD]
+// active is the instrumenter in use, with its key.
+type active struct {
+	Instrumenter
+	key Key
+}
+
+// current holds the instrumenter in use. It is read when the requests are served,
+// while SetInstrumenter may change it, e.g. for the routers wrapped before Init.
+var current atomic.Pointer[active]
+
+func init() {
+	current.Store(&active{Instrumenter: instrumenters[DD], key: DD})
+}
 
 func SetInstrumenter(key Key) {
-	instrumenter = instrumenters[key]
+	instrumenter := instrumenters[key]
 	if instrumenter == nil {
 		panic("unknown key: " + key)
 	}
+	current.Store(&active{Instrumenter: instrumenter, key: key})
+}
+
+// Target returns the key of the current instrumenter.
+func Target() Key {
+	return current.Load().key
 }
 
 func InsertHeader(r *http.Request) *http.Request {
-	return instrumenter.InsertHeader(r)
+	return current.Load().InsertHeader(r)
 }
 
 func Report(ctx context.Context, e event.Event, metadata ...any) context.Context {
-	return instrumenter.Report(ctx, e, metadata...)
+	return current.Load().Report(ctx, e, metadata...)
 }
 
-func WrapHandlerFunc(handlerFunc http.HandlerFunc) http.HandlerFunc {
-	return instrumenter.WrapHandlerFunc(handlerFunc)
+// ReportPanic reports the event e like Report. When recovered, the value returned by recover,
+// is not nil, the panic is reported as an error along with its stack, and ReportPanic panics
+// again with the same value.
+func ReportPanic(ctx context.Context, recovered any, e event.Event, metadata ...any) context.Context {
+	if recovered == nil {
+		return Report(ctx, e, metadata...)
+	}
+	metadata = append(metadata, "error", fmt.Errorf("panic: %v", recovered), "stack", string(debug.Stack()))
+	current.Load().Report(ctx, e, metadata...)
+	panic(recovered)
 }
 
-func WrapHandler(handler http.Handler) http.Handler {
-	return instrumenter.WrapHandler(handler)
+// WrapHandlerFunc instruments handlerFunc. The optional pattern is the route handlerFunc
+// is registered with, e.g. "GET /users/{id}": the spans of the requests are named after it.
+func WrapHandlerFunc(handlerFunc http.HandlerFunc, pattern ...string) http.HandlerFunc {
+	return current.Load().WrapHandlerFunc(handlerFunc, routePattern(pattern))
+}
+
+// WrapHandler instruments handler, like WrapHandlerFunc.
+func WrapHandler(handler http.Handler, pattern ...string) http.Handler {
+	return current.Load().WrapHandler(handler, routePattern(pattern))
+}
+
+// routePattern returns the optional pattern of WrapHandler and WrapHandlerFunc.
+func routePattern(pattern []string) string {
+	if len(pattern) == 0 {
+		return ""
+	}
+	return pattern[0]
+}
+
+// Middleware instruments the requests served by next, like WrapHandler.
+// It can be used by the routers accepting net/http middlewares.
+// The requests are instrumented by the instrumenter set when they are served,
+// as the routers are often built before main calls Init, e.g. in package variables.
+func Middleware(next http.Handler) http.Handler {
+	var (
+		mu sync.Mutex
+		// handlers holds the handlers wrapped by each instrumenter, by target.
+		handlers = map[Key]http.Handler{}
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		instrumenter := current.Load()
+		mu.Lock()
+		h, ok := handlers[instrumenter.key]
+		if !ok {
+			h = instrumenter.WrapHandler(next, "")
+			handlers[instrumenter.key] = h
+		}
+		mu.Unlock()
+		h.ServeHTTP(w, r)
+	})
 }
 
 func WrapHTTPClient(client *http.Client) *http.Client {
-	return instrumenter.WrapHTTPClient(client)
+	return current.Load().WrapHTTPClient(client)
 }
 
-func Init(target string) func() {
+// Init sets the instrumenter of target, and starts it. The optional service is the name
+// of the service reported by the program; the instrumenter picks it when it is not given.
+// It returns the function stopping the instrumenter.
+func Init(target string, service ...string) func() {
 	SetInstrumenter(Key(target))
-	return instrumenter.Init()
+	if len(service) == 0 {
+		return current.Load().Init("")
+	}
+	return current.Load().Init(service[0])
 }
 
 const (
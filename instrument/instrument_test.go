@@ -57,3 +57,29 @@ func TestReport(t *testing.T) {
 		}
 	})
 }
+
+func TestReportPanic(t *testing.T) {
+	t.Run("no panic", func(t *testing.T) {
+		ctx := Report(context.Background(), event.EventStart, "function-name", "doThing")
+		func() {
+			defer func() {
+				ReportPanic(ctx, recover(), event.EventEnd, "function-name", "doThing")
+			}()
+		}()
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		ctx := Report(context.Background(), event.EventStart, "function-name", "doThing")
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("Expected ReportPanic to panic again with boom, got %v", r)
+			}
+		}()
+		func() {
+			defer func() {
+				ReportPanic(ctx, recover(), event.EventEnd, "function-name", "doThing")
+			}()
+			panic("boom")
+		}()
+	})
+}
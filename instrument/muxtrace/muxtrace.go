@@ -0,0 +1,52 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+// Package muxtrace instruments the routers of github.com/gorilla/mux.
+package muxtrace
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jonbodner/orchestrion/instrument"
+	httptrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/net/http"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// WrapRouter adds the tracing middleware of the target to r. The target is
+// the one set when the request is served, see chitrace.WrapRouter.
+// The middleware runs for the requests matching a route of r.
+func WrapRouter(r *mux.Router) *mux.Router {
+	r.Use(middleware)
+	return r
+}
+
+func middleware(next http.Handler) http.Handler {
+	generic := instrument.Middleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if instrument.Target() != instrument.DD {
+			generic.ServeHTTP(w, r)
+			return
+		}
+		// the spans are those of the router of dd-trace-go, named after the route matched
+		var route string
+		resource := r.Method + " unknown"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tpl, err := cur.GetPathTemplate(); err == nil {
+				route, resource = tpl, r.Method+" "+tpl
+			}
+		}
+		httptrace.TraceAndServe(next, w, r, &httptrace.ServeConfig{
+			Resource:    resource,
+			Route:       route,
+			RouteParams: mux.Vars(r),
+			SpanOpts: []tracer.StartSpanOption{
+				tracer.Tag(ext.Component, "gorilla/mux"),
+				tracer.Tag(ext.SpanKind, ext.SpanKindServer),
+			},
+		})
+	})
+}
@@ -0,0 +1,242 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+// Package check reports the code orchestrion would instrument, so that CI can
+// block the changes that forget to run it.
+package check
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jonbodner/orchestrion/internal/config"
+	"github.com/jonbodner/orchestrion/internal/diff"
+	"github.com/jonbodner/orchestrion/internal/instrument"
+)
+
+// Diagnostic reports code that is not instrumented.
+type Diagnostic struct {
+	// File is the name of the file.
+	File string `json:"file"`
+	// Line is the line of the code, starting at 1.
+	Line int `json:"line"`
+	// Message describes the code.
+	Message string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+}
+
+// File returns the diagnostics of the file name, with the source src: the code
+// InstrumentFile would change, with conf. Each statement or declaration changed is
+// reported once, at its first line, and so is each region of inserted lines. The
+// changes of the imports, which come with the others, are not reported.
+func File(name string, src []byte, conf config.Config) ([]Diagnostic, error) {
+	out, err := instrument.InstrumentFile(name, bytes.NewReader(src), conf)
+	if err != nil {
+		return nil, err
+	}
+	instrumented, err := io.ReadAll(out)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, name, src, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	oldLines, newLines := strings.SplitAfter(string(src), "\n"), strings.SplitAfter(string(instrumented), "\n")
+	var ds []Diagnostic
+	reported := map[int]bool{}
+	for _, c := range diff.Changes(src, instrumented) {
+		if isImport(region(oldLines, c.OldLine, c.OldLines)) && isImport(region(newLines, c.NewLine, c.NewLines)) {
+			continue
+		}
+		if c.OldLines == 0 {
+			d := Diagnostic{File: name, Line: c.OldLine}
+			if d.Line == 0 {
+				d.Line = 1
+			}
+			// the lines inserted are described by their code, rather than by the markers around it
+			d.Message = "missing instrumentation: would add " + firstCode(region(newLines, c.NewLine, c.NewLines))
+			ds = append(ds, d)
+			continue
+		}
+		for l := c.OldLine; l < c.OldLine+c.OldLines; l++ {
+			if strings.TrimSpace(oldLines[l-1]) == "" {
+				continue
+			}
+			start := statementLine(fset, file, l)
+			if reported[start] {
+				continue
+			}
+			reported[start] = true
+			ds = append(ds, Diagnostic{File: name, Line: start, Message: "missing instrumentation: " + strings.TrimSpace(oldLines[start-1])})
+		}
+	}
+	sort.SliceStable(ds, func(i, j int) bool { return ds[i].Line < ds[j].Line })
+	return ds, nil
+}
+
+// statementLine returns the first line of the innermost statement or declaration of
+// file spanning line, or line when there is none.
+func statementLine(fset *token.FileSet, file *ast.File, line int) int {
+	start := line
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		from, to := fset.Position(n.Pos()).Line, fset.Position(n.End()).Line
+		if line < from || line > to {
+			return false
+		}
+		switch n.(type) {
+		case *ast.BlockStmt:
+			// the lines of a block belong to its statement
+		case ast.Stmt, ast.Spec, ast.Decl:
+			start = from
+		}
+		return true
+	})
+	return start
+}
+
+// region returns the n lines starting at line, starting at 1.
+func region(lines []string, line, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	return lines[line-1 : line-1+n]
+}
+
+// firstCode returns the first line of lines holding code, or their first line if none does.
+func firstCode(lines []string) string {
+	for _, l := range lines {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "//") {
+			return l
+		}
+	}
+	return strings.TrimSpace(lines[0])
+}
+
+// importLine matches the lines of import declarations.
+var importLine = regexp.MustCompile(`^(import\s*\(|import\s+(\w+\s+)?"[^"]*"|\)|(\w+\s+)?"[^"]*"|)$`)
+
+// isImport reports whether lines only hold import declarations, or are blank.
+func isImport(lines []string) bool {
+	for _, l := range lines {
+		if !importLine.MatchString(strings.TrimSpace(l)) {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteText writes the diagnostics ds to w, one per line as file:line: message.
+func WriteText(w io.Writer, ds []Diagnostic) error {
+	for _, d := range ds {
+		if _, err := fmt.Fprintln(w, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the diagnostics ds to w, as a JSON array.
+func WriteJSON(w io.Writer, ds []Diagnostic) error {
+	if ds == nil {
+		ds = []Diagnostic{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ds)
+}
+
+// ruleID identifies the diagnostics of orchestrion in SARIF logs.
+const ruleID = "missing-instrumentation"
+
+// WriteSARIF writes the diagnostics ds to w, as a SARIF 2.1.0 log. The file names are
+// made relative to root, as SARIF viewers expect paths relative to the repository.
+func WriteSARIF(w io.Writer, ds []Diagnostic, root string) error {
+	type (
+		message struct {
+			Text string `json:"text"`
+		}
+		location struct {
+			PhysicalLocation struct {
+				ArtifactLocation struct {
+					URI string `json:"uri"`
+				} `json:"artifactLocation"`
+				Region struct {
+					StartLine int `json:"startLine"`
+				} `json:"region"`
+			} `json:"physicalLocation"`
+		}
+		result struct {
+			RuleID    string     `json:"ruleId"`
+			Level     string     `json:"level"`
+			Message   message    `json:"message"`
+			Locations []location `json:"locations"`
+		}
+		rule struct {
+			ID               string  `json:"id"`
+			ShortDescription message `json:"shortDescription"`
+		}
+		driver struct {
+			Name           string `json:"name"`
+			InformationURI string `json:"informationUri"`
+			Rules          []rule `json:"rules"`
+		}
+		run struct {
+			Tool struct {
+				Driver driver `json:"driver"`
+			} `json:"tool"`
+			Results []result `json:"results"`
+		}
+		log struct {
+			Version string `json:"version"`
+			Schema  string `json:"$schema"`
+			Runs    []run  `json:"runs"`
+		}
+	)
+	var r run
+	r.Tool.Driver = driver{
+		Name:           "orchestrion",
+		InformationURI: "https://github.com/jonbodner/orchestrion",
+		Rules:          []rule{{ID: ruleID, ShortDescription: message{Text: "Code that orchestrion would instrument"}}},
+	}
+	r.Results = []result{}
+	for _, d := range ds {
+		var l location
+		l.PhysicalLocation.ArtifactLocation.URI = relativeURI(root, d.File)
+		l.PhysicalLocation.Region.StartLine = d.Line
+		r.Results = append(r.Results, result{RuleID: ruleID, Level: "error", Message: message{Text: d.Message}, Locations: []location{l}})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []run{r},
+	})
+}
+
+// relativeURI returns the URI of the file name relative to root, when it is below it.
+func relativeURI(root, name string) string {
+	if rel, err := filepath.Rel(root, name); err == nil && !strings.HasPrefix(rel, "..") {
+		name = rel
+	}
+	return filepath.ToSlash(name)
+}
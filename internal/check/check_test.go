@@ -0,0 +1,137 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package check
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jonbodner/orchestrion/internal/config"
+	"github.com/jonbodner/orchestrion/internal/instrument"
+
+	"github.com/stretchr/testify/require"
+)
+
+const code = `package main
+
+import "net/http"
+
+func register() {
+	http.HandleFunc("/orders", handleOrders)
+}
+
+func handleOrders(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+`
+
+func TestFile(t *testing.T) {
+	conf := config.Config{HTTPMode: "wrap", Instrumentation: "console"}
+	ds, err := File("/app/main.go", []byte(code), conf)
+	require.NoError(t, err)
+	require.Equal(t, []Diagnostic{
+		{File: "/app/main.go", Line: 6, Message: `missing instrumentation: http.HandleFunc("/orders", handleOrders)`},
+	}, ds)
+
+	ds, err = File("/app/work.go", []byte(`package main
+
+import "context"
+
+//dd:span
+func work(ctx context.Context) {
+}
+`), conf)
+	require.NoError(t, err)
+	require.Equal(t, []Diagnostic{
+		{File: "/app/work.go", Line: 6, Message: `missing instrumentation: would add ctx = instrument.Report(ctx, instrument.EventStart, "function-name", "work")`},
+	}, ds)
+
+	// the instrumented code reports nothing
+	out, err := instrument.InstrumentFile("/app/main.go", strings.NewReader(code), conf)
+	require.NoError(t, err)
+	instrumented, err := io.ReadAll(out)
+	require.NoError(t, err)
+	ds, err = File("/app/main.go", instrumented, conf)
+	require.NoError(t, err)
+	require.Empty(t, ds)
+}
+
+func TestFileAdjacentChanges(t *testing.T) {
+	conf := config.Config{HTTPMode: "wrap", Instrumentation: "console"}
+	ds, err := File("/app/main.go", []byte(`package main
+
+import "net/http"
+
+func register(h http.Handler) {
+	http.Handle("/u", h)
+	http.HandleFunc("/", handle)
+	http.HandleFunc("/v", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+`), conf)
+	require.NoError(t, err)
+	require.Equal(t, []Diagnostic{
+		{File: "/app/main.go", Line: 6, Message: `missing instrumentation: http.Handle("/u", h)`},
+		{File: "/app/main.go", Line: 7, Message: `missing instrumentation: http.HandleFunc("/", handle)`},
+		{File: "/app/main.go", Line: 8, Message: `missing instrumentation: http.HandleFunc("/v", func(w http.ResponseWriter, r *http.Request) {`},
+	}, ds)
+}
+
+func TestWrite(t *testing.T) {
+	ds := []Diagnostic{
+		{File: "/app/api/orders.go", Line: 12, Message: "missing instrumentation: sql.Open(driver, dsn)"},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, WriteText(&out, ds))
+	require.Equal(t, "/app/api/orders.go:12: missing instrumentation: sql.Open(driver, dsn)\n", out.String())
+
+	out.Reset()
+	require.NoError(t, WriteJSON(&out, nil))
+	require.Equal(t, "[]\n", out.String())
+	out.Reset()
+	require.NoError(t, WriteJSON(&out, ds))
+	var got []Diagnostic
+	require.NoError(t, json.Unmarshal(out.Bytes(), &got))
+	require.Equal(t, ds, got)
+
+	out.Reset()
+	require.NoError(t, WriteSARIF(&out, ds, "/app"))
+	var log struct {
+		Version string
+		Runs    []struct {
+			Results []struct {
+				RuleID    string
+				Level     string
+				Message   struct{ Text string }
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct{ URI string }
+						Region           struct{ StartLine int }
+					}
+				}
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &log))
+	require.Equal(t, "2.1.0", log.Version)
+	require.Len(t, log.Runs, 1)
+	require.Len(t, log.Runs[0].Results, 1)
+	r := log.Runs[0].Results[0]
+	require.Equal(t, ruleID, r.RuleID)
+	require.Equal(t, "error", r.Level)
+	require.Equal(t, ds[0].Message, r.Message.Text)
+	require.Equal(t, "api/orders.go", r.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	require.Equal(t, 12, r.Locations[0].PhysicalLocation.Region.StartLine)
+}
@@ -7,28 +7,75 @@ package config
 
 import (
 	"fmt"
+	"path"
+	"regexp"
 	"strings"
+
+	"github.com/jonbodner/orchestrion/internal/rules"
 )
 
 // Config holds the instrumentation config
 type Config struct {
 	// HTTPMode controls the technique used for HTTP instrumentation
 	// The possible values are "wrap", "report"
-	HTTPMode string
+	HTTPMode string `yaml:"httpmode"`
 	// Instrumentation specifies which output format is used
 	// The possible values are "console", "dd", or "otel"
-	Instrumentation string
+	Instrumentation string `yaml:"target"`
+	// Service is the name of the service reported by the instrumented programs.
+	// When empty, the tracer picks it
+	Service string `yaml:"service"`
+	// Rules holds user-defined injection points, applied along with rules.Builtin
+	Rules []rules.Rule `yaml:"rules"`
+	// Contexts holds user-defined context accessors, used along with rules.BuiltinContexts
+	Contexts []rules.Context `yaml:"contexts"`
+	// LineDirectives adds line directives to the instrumented code, so that it
+	// keeps the positions of the original code when compiled from another file
+	LineDirectives bool `yaml:"-"`
+	// RecordPanics makes the instrumented handlers and spans report the panics
+	// as errors before panicking again
+	RecordPanics bool `yaml:"panics"`
+	// WrapDefaultClient makes main wrap http.DefaultClient, in wrap mode, so that
+	// the requests made with http.Get and the like are traced
+	WrapDefaultClient bool `yaml:"defaultclient"`
+	// Prefix is the prefix of the directives written by orchestrion, e.g. orchestrion
+	// for //orchestrion:startwrap. The directives prefixed with dd or orchestrion are
+	// recognized whatever the prefix. An empty prefix is dd.
+	Prefix string `yaml:"prefix"`
+	// Include holds the patterns of the import paths of the packages to instrument,
+	// e.g. example.com/app/... When empty, all the packages are instrumented
+	Include []string `yaml:"include"`
+	// Exclude holds the patterns of the import paths of the packages not to instrument
+	Exclude []string `yaml:"exclude"`
+	// IncludeFiles holds the globs of the names of the files to instrument, e.g. *.go
+	// or internal/api/*.go. When empty, all the files are instrumented
+	IncludeFiles []string `yaml:"includefiles"`
+	// ExcludeFiles holds the globs of the names of the files not to instrument, e.g. *_test.go
+	ExcludeFiles []string `yaml:"excludefiles"`
+	// GOOS, GOARCH and BuildTags select the build the files are type checked for. The
+	// files of other builds are checked with the first variant of it selecting them.
+	// The empty fields are those of the environment
+	GOOS      string   `yaml:"goos"`
+	GOARCH    string   `yaml:"goarch"`
+	BuildTags []string `yaml:"tags"`
+	// Integrations holds the integrations enabled, e.g. "http" or "sql", see
+	// rules.Integrations. When empty, all the integrations are enabled
+	Integrations []string `yaml:"integrations"`
+	// Spans holds the rules naming the spans of the //dd:span functions
+	Spans []SpanName `yaml:"spans"`
+	// Packages holds the settings overridden for some packages
+	Packages []Override `yaml:"packages"`
 }
 
-var Default = Config{HTTPMode: "wrap", Instrumentation: "console"}
+var Default = Config{HTTPMode: "wrap", Instrumentation: "console", Prefix: "dd"}
+
+// validPrefix matches the prefixes of the directives, e.g. dd for //dd:span.
+var validPrefix = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
 
 func (c *Config) Validate() error {
 	c.HTTPMode = strings.ToLower(c.HTTPMode)
-	switch c.HTTPMode {
-	case "wrap", "report":
-		// do nothing
-	default:
-		return fmt.Errorf("invalid httpmode %q, the supported values are wrap or report", c.HTTPMode)
+	if err := validateHTTPMode(c.HTTPMode); err != nil {
+		return err
 	}
 	c.Instrumentation = strings.ToLower(c.Instrumentation)
 	switch c.Instrumentation {
@@ -37,5 +84,112 @@ func (c *Config) Validate() error {
 	default:
 		return fmt.Errorf("invalid target %q, the supported values are console, dd, or otel", c.Instrumentation)
 	}
+	if c.Prefix != "" && !validPrefix.MatchString(c.Prefix) {
+		return fmt.Errorf("invalid prefix %q, it must be made of lower case letters and digits", c.Prefix)
+	}
+	for i := range c.Rules {
+		if err := c.Rules[i].Validate(); err != nil {
+			return err
+		}
+	}
+	for _, ctx := range c.Contexts {
+		if err := ctx.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, patterns := range [][]string{c.Include, c.Exclude} {
+		for _, p := range patterns {
+			if err := validatePattern(p); err != nil {
+				return err
+			}
+		}
+	}
+	for _, globs := range [][]string{c.IncludeFiles, c.ExcludeFiles} {
+		for _, g := range globs {
+			if _, err := path.Match(g, ""); err != nil || g == "" {
+				return fmt.Errorf("invalid file glob %q", g)
+			}
+		}
+	}
+	if err := c.validateIntegrations(c.Integrations); err != nil {
+		return err
+	}
+	for _, s := range c.Spans {
+		if err := s.validate(); err != nil {
+			return err
+		}
+	}
+	for i := range c.Packages {
+		if err := c.validateOverride(&c.Packages[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateHTTPMode(mode string) error {
+	switch mode {
+	case "wrap", "report":
+		return nil
+	}
+	return fmt.Errorf("invalid httpmode %q, the supported values are wrap or report", mode)
+}
+
+// validateIntegrations checks that the integrations are those of the builtin rules, or of Rules.
+func (c *Config) validateIntegrations(integrations []string) error {
+	known := map[string]bool{}
+	for _, rs := range [][]rules.Rule{rules.Builtin, c.Rules} {
+		for _, r := range rs {
+			known[r.Integration] = true
+		}
+	}
+	for _, name := range integrations {
+		if name == "" || !known[name] {
+			return fmt.Errorf("invalid integration %q, the supported values are %s", name, strings.Join(rules.Integrations, ", "))
+		}
+	}
+	return nil
+}
+
+// Enabled reports whether the integration is enabled. The rules without integration
+// always are.
+func (c Config) Enabled(integration string) bool {
+	if integration == "" || len(c.Integrations) == 0 {
+		return true
+	}
+	for _, v := range c.Integrations {
+		if v == integration {
+			return true
+		}
+	}
+	return false
+}
+
+// SpanName returns the name of the span of the //dd:span function fn, after the
+// first rule of Spans matching it. Without a match, the span is named after fn.
+func (c Config) SpanName(fn string) string {
+	for _, s := range c.Spans {
+		if ok, _ := path.Match(s.Function, fn); ok {
+			return strings.ReplaceAll(s.Name, "{function}", fn)
+		}
+	}
+	return fn
+}
+
+// SpanName names the spans of the //dd:span functions matching Function.
+type SpanName struct {
+	// Function is a pattern of the names of the functions, e.g. Handle*, with the syntax of path.Match.
+	Function string `yaml:"function"`
+	// Name is the name of the span. {function} stands for the name of the function.
+	Name string `yaml:"name"`
+}
+
+func (s SpanName) validate() error {
+	if s.Function == "" || s.Name == "" {
+		return fmt.Errorf("span name %q: needs a function and a name", s.Name)
+	}
+	if _, err := path.Match(s.Function, ""); err != nil {
+		return fmt.Errorf("span name %q: invalid function pattern %q: %w", s.Name, s.Function, err)
+	}
 	return nil
 }
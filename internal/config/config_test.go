@@ -0,0 +1,115 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/app\n\ngo 1.19\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, FileName), []byte(`target: dd
+httpmode: report
+service: checkout
+exclude: [example.com/app/internal/generated/...]
+integrations: [http, sql]
+spans:
+  - function: Handle*
+    name: handler.{function}
+packages:
+  - package: example.com/app/legacy/...
+    httpmode: wrap
+    panics: true
+`), 0644))
+	sub := filepath.Join(root, "cmd", "app")
+	require.NoError(t, os.MkdirAll(sub, 0755))
+
+	name, ok := Find(sub)
+	require.True(t, ok)
+	require.Equal(t, filepath.Join(root, FileName), name)
+
+	c, err := Load(name)
+	require.NoError(t, err)
+	require.NoError(t, c.Validate())
+	require.Equal(t, "dd", c.Instrumentation)
+	require.Equal(t, "report", c.HTTPMode)
+	require.Equal(t, "checkout", c.Service)
+
+	require.True(t, c.Includes("example.com/app"))
+	require.True(t, c.Includes("example.com/app/internal/generatedcode"))
+	require.False(t, c.Includes("example.com/app/internal/generated"))
+	require.False(t, c.Includes("example.com/app/internal/generated/api"))
+
+	require.True(t, c.Enabled("http"))
+	require.True(t, c.Enabled(""))
+	require.False(t, c.Enabled("grpc"))
+
+	require.Equal(t, "handler.HandleOrder", c.SpanName("HandleOrder"))
+	require.Equal(t, "doThing", c.SpanName("doThing"))
+
+	legacy := c.For("example.com/app/legacy/api")
+	require.Equal(t, "wrap", legacy.HTTPMode)
+	require.True(t, legacy.RecordPanics)
+	require.Equal(t, "report", c.For("example.com/app/api").HTTPMode)
+}
+
+func TestFindNone(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/app\n\ngo 1.19\n"), 0644))
+	_, ok := Find(root)
+	require.False(t, ok)
+}
+
+func TestValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		file string
+		err  string
+	}{
+		"unknown field": {
+			file: "target: dd\nmodes: wrap\n",
+			err:  "field modes not found",
+		},
+		"integration": {
+			file: "target: dd\nhttpmode: wrap\nintegrations: [redis]\n",
+			err:  `invalid integration "redis"`,
+		},
+		"override": {
+			file: "target: dd\nhttpmode: wrap\npackages:\n  - package: example.com/app\n    httpmode: both\n",
+			err:  `package override example.com/app: invalid httpmode "both"`,
+		},
+		"span": {
+			file: "target: dd\nhttpmode: wrap\nspans:\n  - function: \"[\"\n    name: x\n",
+			err:  `invalid function pattern`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), FileName)
+			require.NoError(t, os.WriteFile(fileName, []byte(tc.file), 0644))
+			c, err := Load(fileName)
+			if err == nil {
+				err = c.Validate()
+			}
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestIncludesFile(t *testing.T) {
+	c := Config{ExcludeFiles: []string{"*_test.go", "internal/gen/*.go"}}
+	require.True(t, c.IncludesFile("/src/app/main.go"))
+	require.False(t, c.IncludesFile("/src/app/main_test.go"))
+	require.False(t, c.IncludesFile("/src/app/internal/gen/types.go"))
+	require.True(t, c.IncludesFile("/src/app/internal/types.go"))
+
+	c = Config{IncludeFiles: []string{"api/*.go"}}
+	require.True(t, c.IncludesFile("api/api.go"))
+	require.False(t, c.IncludesFile("main.go"))
+}
@@ -0,0 +1,213 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the name of the configuration file, at the root of the module.
+const FileName = "orchestrion.yml"
+
+// Find returns the name of the configuration file of the module holding dir, if any.
+func Find(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			name := filepath.Join(dir, FileName)
+			if _, err := os.Stat(name); err != nil {
+				return "", false
+			}
+			return name, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// Load reads the configuration file name. It holds the fields of Config under their
+// yaml names, e.g.:
+//
+//	target: dd
+//	httpmode: report
+//	service: checkout
+//	exclude: [example.com/app/internal/generated/...]
+//	integrations: [http, sql]
+//	spans:
+//	  - function: Handle*
+//	    name: handler.{function}
+//	packages:
+//	  - package: example.com/app/legacy/...
+//	    httpmode: wrap
+//
+// The configuration is not validated, so that it can be completed first, e.g. with
+// command line flags.
+func Load(name string) (Config, error) {
+	var c Config
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return c, fmt.Errorf("error reading config: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return c, fmt.Errorf("error parsing config in %s: %w", name, err)
+	}
+	return c, nil
+}
+
+// Override holds the settings overridden for the packages matching Package.
+// The empty settings are not overridden.
+type Override struct {
+	// Package is the pattern of the import paths of the packages, e.g. example.com/app/legacy/...
+	Package string `yaml:"package"`
+	// HTTPMode overrides Config.HTTPMode.
+	HTTPMode string `yaml:"httpmode"`
+	// RecordPanics overrides Config.RecordPanics.
+	RecordPanics *bool `yaml:"panics"`
+	// Integrations overrides Config.Integrations.
+	Integrations []string `yaml:"integrations"`
+	// Spans are looked up before Config.Spans.
+	Spans []SpanName `yaml:"spans"`
+}
+
+func (c *Config) validateOverride(o *Override) error {
+	if o.Package == "" {
+		return errors.New("package override: missing package")
+	}
+	if err := validatePattern(o.Package); err != nil {
+		return err
+	}
+	if o.HTTPMode != "" {
+		o.HTTPMode = strings.ToLower(o.HTTPMode)
+		if err := validateHTTPMode(o.HTTPMode); err != nil {
+			return fmt.Errorf("package override %s: %w", o.Package, err)
+		}
+	}
+	if err := c.validateIntegrations(o.Integrations); err != nil {
+		return fmt.Errorf("package override %s: %w", o.Package, err)
+	}
+	for _, s := range o.Spans {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("package override %s: %w", o.Package, err)
+		}
+	}
+	return nil
+}
+
+// Includes reports whether the package pkgPath is instrumented, after Include and Exclude.
+func (c Config) Includes(pkgPath string) bool {
+	included := len(c.Include) == 0
+	for _, p := range c.Include {
+		if matchPackage(p, pkgPath) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, p := range c.Exclude {
+		if matchPackage(p, pkgPath) {
+			return false
+		}
+	}
+	return true
+}
+
+// IncludesFile reports whether the file name is instrumented, after IncludeFiles and
+// ExcludeFiles.
+func (c Config) IncludesFile(name string) bool {
+	included := len(c.IncludeFiles) == 0
+	for _, g := range c.IncludeFiles {
+		if matchFile(g, name) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, g := range c.ExcludeFiles {
+		if matchFile(g, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// For returns the configuration of the package pkgPath, with the settings of the
+// overrides matching it, in order.
+func (c Config) For(pkgPath string) Config {
+	for _, o := range c.Packages {
+		if !matchPackage(o.Package, pkgPath) {
+			continue
+		}
+		if o.HTTPMode != "" {
+			c.HTTPMode = o.HTTPMode
+		}
+		if o.RecordPanics != nil {
+			c.RecordPanics = *o.RecordPanics
+		}
+		if len(o.Integrations) > 0 {
+			c.Integrations = o.Integrations
+		}
+		if len(o.Spans) > 0 {
+			c.Spans = append(append([]SpanName{}, o.Spans...), c.Spans...)
+		}
+	}
+	return c
+}
+
+// validatePattern checks the package pattern p.
+func validatePattern(p string) error {
+	if p == "" || strings.ContainsAny(p, " \t\\") {
+		return fmt.Errorf("invalid package pattern %q", p)
+	}
+	return nil
+}
+
+// matchPackage reports whether the import path pkgPath matches the pattern, like
+// the go command: ... matches any string, and a trailing /... matches the package too,
+// e.g. example.com/app/... matches example.com/app and example.com/app/api.
+func matchPackage(pattern, pkgPath string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.ReplaceAll(re, `\.\.\.`, `.*`)
+	if strings.HasSuffix(re, `/.*`) {
+		re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+	}
+	ok, _ := regexp.MatchString(`^`+re+`$`, pkgPath)
+	return ok
+}
+
+// matchFile reports whether the file name matches the glob, with the syntax of path.Match.
+// A glob without slash matches the base name of the file, e.g. *.pb.go, and the others
+// match its last path elements, e.g. internal/api/*.go.
+func matchFile(glob, name string) bool {
+	elems := strings.Split(filepath.ToSlash(name), "/")
+	n := strings.Count(glob, "/") + 1
+	if n > len(elems) {
+		return false
+	}
+	ok, _ := path.Match(glob, strings.Join(elems[len(elems)-n:], "/"))
+	return ok
+}
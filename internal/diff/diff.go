@@ -0,0 +1,243 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+// Package diff computes the line differences between two files, and prints them
+// in the unified format, like gofmt -d.
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// context is the number of unchanged lines printed around the changes.
+const context = 3
+
+// op is an edit of a line: kept, deleted from the old file or inserted in the new one.
+type op byte
+
+const (
+	keep op = ' '
+	del  op = '-'
+	ins  op = '+'
+)
+
+// edit is an edit of the line of the old file at index x, or of the new file at index y.
+type edit struct {
+	op   op
+	x, y int
+}
+
+// Unified returns the unified diff of the files old and new, named oldName and newName,
+// or nil when they are equal.
+func Unified(oldName, newName string, old, new []byte) []byte {
+	if bytes.Equal(old, new) {
+		return nil
+	}
+	a, b := lines(old), lines(new)
+	edits := diff(a, b)
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	for start := 0; start < len(edits); {
+		// find the next change, and the end of its hunk: the hunks are separated by
+		// more than 2*context unchanged lines.
+		for start < len(edits) && edits[start].op == keep {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+		end := start
+		for kept := 0; end < len(edits) && kept <= 2*context; end++ {
+			if edits[end].op == keep {
+				kept++
+			} else {
+				kept = 0
+			}
+		}
+		for end > start && edits[end-1].op == keep {
+			end--
+		}
+		from := start - context
+		if from < 0 {
+			from = 0
+		}
+		to := end + context
+		if to > len(edits) {
+			to = len(edits)
+		}
+		writeHunk(&out, edits[from:to], a, b)
+		start = to
+	}
+	return out.Bytes()
+}
+
+// Change is a region of lines that differ between two files.
+type Change struct {
+	// OldLine is the first line of the region in the old file, starting at 1.
+	// When the region only inserts lines, it is the line they are inserted after.
+	OldLine int
+	// OldLines is the number of lines of the region in the old file.
+	OldLines int
+	// NewLine is the first line of the region in the new file, starting at 1.
+	NewLine int
+	// NewLines is the number of lines of the region in the new file.
+	NewLines int
+}
+
+// Changes returns the regions of lines that differ between the files old and new, in order.
+func Changes(old, new []byte) []Change {
+	if bytes.Equal(old, new) {
+		return nil
+	}
+	var out []Change
+	edits := diff(lines(old), lines(new))
+	for i := 0; i < len(edits); {
+		if edits[i].op == keep {
+			i++
+			continue
+		}
+		c := Change{OldLine: edits[i].x + 1, NewLine: edits[i].y + 1}
+		for ; i < len(edits) && edits[i].op != keep; i++ {
+			if edits[i].op == del {
+				c.OldLines++
+			} else {
+				c.NewLines++
+			}
+		}
+		if c.OldLines == 0 {
+			c.OldLine--
+		}
+		if c.NewLines == 0 {
+			c.NewLine--
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// writeHunk prints the hunk of the edits.
+func writeHunk(out *bytes.Buffer, edits []edit, a, b []string) {
+	var oldLines, newLines int
+	for _, e := range edits {
+		if e.op != ins {
+			oldLines++
+		}
+		if e.op != del {
+			newLines++
+		}
+	}
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(edits[0].x, oldLines), hunkRange(edits[0].y, newLines))
+	for _, e := range edits {
+		line := b[e.y]
+		if e.op == del {
+			line = a[e.x]
+		}
+		out.WriteByte(byte(e.op))
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange returns the range of n lines starting at index i, in the hunk header format.
+func hunkRange(i, n int) string {
+	switch n {
+	case 0:
+		// an empty range refers to the line before it
+		return fmt.Sprintf("%d,0", i)
+	case 1:
+		return fmt.Sprintf("%d", i+1)
+	}
+	return fmt.Sprintf("%d,%d", i+1, n)
+}
+
+// lines splits s after each newline.
+func lines(s []byte) []string {
+	var out []string
+	for len(s) > 0 {
+		i := bytes.IndexByte(s, '\n') + 1
+		if i == 0 {
+			i = len(s)
+		}
+		out = append(out, string(s[:i]))
+		s = s[i:]
+	}
+	return out
+}
+
+// diff returns the shortest edit script turning a into b, with the algorithm of
+// E. Myers, "An O(ND) Difference Algorithm and Its Variations".
+// For each edit: the edits keeping and deleting lines refer to the line x of a,
+// and the edits keeping and inserting lines to the line y of b.
+func diff(a, b []string) []edit {
+	n, m := len(a), len(b)
+	offset := n + m
+	// v[k+offset] is the furthest x reached on the diagonal k = x-y, and trace the
+	// copies of v after each step d.
+	v := make([]int, 2*offset+2)
+	var trace [][]int
+	for d := 0; d <= offset; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+				x = v[k+1+offset]
+			} else {
+				x = v[k-1+offset] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[k+offset] = x
+			if x >= n && y >= m {
+				trace = append(trace, append([]int(nil), v...))
+				return backtrack(trace, n, m, offset)
+			}
+		}
+		trace = append(trace, append([]int(nil), v...))
+	}
+	return nil
+}
+
+// backtrack returns the edits found by diff, from the furthest x reached by each step.
+func backtrack(trace [][]int, n, m, offset int) []edit {
+	var edits []edit
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d-1]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+offset]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			edits = append(edits, edit{op: keep, x: x, y: y})
+		}
+		if x == prevX {
+			y--
+			edits = append(edits, edit{op: ins, x: x, y: y})
+		} else {
+			x--
+			edits = append(edits, edit{op: del, x: x, y: y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		edits = append(edits, edit{op: keep, x: x, y: y})
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
@@ -0,0 +1,118 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package diff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnified(t *testing.T) {
+	numbered := func(from, to int, extra map[int]string) string {
+		var b strings.Builder
+		for i := from; i <= to; i++ {
+			if s, ok := extra[i]; ok {
+				b.WriteString(s)
+			}
+			b.WriteString(strings.Repeat("x", i%3) + "line\n")
+		}
+		return b.String()
+	}
+	for name, tc := range map[string]struct {
+		old, new string
+		want     string
+	}{
+		"equal": {
+			old: "a\nb\n",
+			new: "a\nb\n",
+		},
+		"insert": {
+			old: "package main\n\nfunc main() {\n}\n",
+			new: "package main\n\nfunc main() {\n\tdefer stop()\n}\n",
+			want: `--- a.go.orig
++++ a.go
+@@ -1,4 +1,5 @@
+ package main
+ 
+ func main() {
++	defer stop()
+ }
+`,
+		},
+		"replace": {
+			old: "a\nb\nc\n",
+			new: "a\nB\nc\n",
+			want: `--- a.go.orig
++++ a.go
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+`,
+		},
+		"empty": {
+			old: "",
+			new: "a\n",
+			want: `--- a.go.orig
++++ a.go
+@@ -0,0 +1 @@
++a
+`,
+		},
+		"no newline": {
+			old: "a\nb",
+			new: "a\nc",
+			want: `--- a.go.orig
++++ a.go
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++c
+\ No newline at end of file
+`,
+		},
+		"hunks": {
+			old: numbered(1, 20, nil),
+			new: numbered(1, 20, map[int]string{2: "new1\n", 18: "new2\n"}),
+			want: `--- a.go.orig
++++ a.go
+@@ -1,4 +1,5 @@
+ xline
++new1
+ xxline
+ line
+ xline
+@@ -15,6 +16,7 @@
+ line
+ xline
+ xxline
++new2
+ line
+ xline
+ xxline
+`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := Unified("a.go.orig", "a.go", []byte(tc.old), []byte(tc.new))
+			require.Equal(t, tc.want, string(got))
+		})
+	}
+}
+
+func TestChanges(t *testing.T) {
+	old := "a\nb\nc\nd\n"
+	new := "a\nx\ny\nc\nd\nz\n"
+	require.Equal(t, []Change{
+		{OldLine: 2, OldLines: 1, NewLine: 2, NewLines: 2},
+		{OldLine: 4, OldLines: 0, NewLine: 6, NewLines: 1},
+	}, Changes([]byte(old), []byte(new)))
+	require.Nil(t, Changes([]byte(old), []byte(old)))
+}
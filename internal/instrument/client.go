@@ -0,0 +1,276 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package instrument
+
+import (
+	"go/token"
+
+	"github.com/jonbodner/orchestrion/internal/config"
+	"github.com/jonbodner/orchestrion/internal/rules"
+	"github.com/jonbodner/orchestrion/internal/typechecker"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+// clientFunctions maps the functions of net/http, and the methods of http.Client,
+// to the functions of the instrument package replacing them in report mode.
+var clientFunctions = map[string]string{
+	"Do":       "HTTPDo",
+	"Get":      "HTTPGet",
+	"Head":     "HTTPHead",
+	"Post":     "HTTPPost",
+	"PostForm": "HTTPPostForm",
+}
+
+// scope holds what is known of the function being instrumented.
+type scope struct {
+	// ctx is the context available to the function, if any.
+	ctx *contextInfo
+	// requests holds the names of the requests already reported by a
+	// //dd:startinstrument block after their creation.
+	requests map[string]bool
+}
+
+// newScope returns the scope of a function with the parameters params, nested in parent.
+// A function without a context parameter uses the context of its parent.
+func newScope(params *dst.FieldList, parent *scope, tc *typechecker.TypeChecker, conf config.Config) *scope {
+	sc := &scope{requests: map[string]bool{}}
+	if ci, ok := paramContext(params, tc, conf); ok {
+		sc.ctx = &ci
+	} else if parent != nil {
+		sc.ctx = parent.ctx
+	}
+	return sc
+}
+
+// declScope returns the scope of the function decl. The root span of a //dd:span
+// function without a context parameter is in scope.
+func declScope(decl *dst.FuncDecl, tc *typechecker.TypeChecker, conf config.Config) *scope {
+	sc := newScope(decl.Type.Params, nil, tc, conf)
+	if sc.ctx == nil && hasLabel(dd_span, decl.Decorations().Start.All()) {
+		sc.ctx = &contextInfo{contextType: background}
+	}
+	return sc
+}
+
+// contextExpr returns the expression of the context in scope, or context.Background().
+func (sc *scope) contextExpr() dst.Expr {
+	if sc.ctx != nil {
+		if expr := dupCtxExprForSpan(*sc.ctx); expr != nil {
+			return expr
+		}
+	}
+	return &dst.CallExpr{Fun: &dst.Ident{Name: "Background", Path: "context"}}
+}
+
+// reportClientCalls replaces the calls made by stmt with an http.Client by their
+// reporting equivalent, e.g. http.Get(url) by instrument.HTTPGet(ctx, nil, url),
+// and client.Do(req) by instrument.HTTPDo(client, req).
+// It reports whether stmt was changed.
+func reportClientCalls(stmt dst.Stmt, sc *scope, tc *typechecker.TypeChecker) bool {
+	changed := false
+	for _, call := range callsOf(stmt) {
+		var client dst.Expr
+		switch f := call.Fun.(type) {
+		case *dst.Ident:
+			if f.Path != "net/http" || f.Name == "Do" || clientFunctions[f.Name] == "" {
+				continue
+			}
+			client = &dst.Ident{Name: "nil"}
+		case *dst.SelectorExpr:
+			if clientFunctions[f.Sel.Name] == "" || !isClient(f.X, tc) {
+				continue
+			}
+			client = f.X
+			if tc.TypeOf(f.X) == "net/http.Client" {
+				client = &dst.UnaryExpr{Op: token.AND, X: f.X}
+			}
+		default:
+			continue
+		}
+		name := funcName(call)
+		if name == "Do" {
+			if len(call.Args) != 1 || isReported(call.Args[0], sc) {
+				continue
+			}
+			call.Args = []dst.Expr{client, call.Args[0]}
+		} else {
+			call.Args = append([]dst.Expr{sc.contextExpr(), client}, call.Args...)
+		}
+		call.Fun = &dst.Ident{Name: clientFunctions[name], Path: rules.RuntimePackage}
+		changed = true
+	}
+	return changed
+}
+
+// isClient reports whether expr is an http.Client, or a pointer to one.
+func isClient(expr dst.Expr, tc *typechecker.TypeChecker) bool {
+	if id, ok := expr.(*dst.Ident); ok && id.Path == "net/http" && id.Name == "DefaultClient" {
+		return true
+	}
+	return hasType(expr, "net/http", "Client", tc)
+}
+
+// isReported reports whether req is a request reported after its creation.
+func isReported(req dst.Expr, sc *scope) bool {
+	id, ok := req.(*dst.Ident)
+	return ok && sc.requests[id.Name]
+}
+
+// funcName returns the name of the function or method called by call.
+func funcName(call *dst.CallExpr) string {
+	switch f := call.Fun.(type) {
+	case *dst.Ident:
+		return f.Name
+	case *dst.SelectorExpr:
+		return f.Sel.Name
+	}
+	return ""
+}
+
+// addRequestContext replaces http.NewRequest(args) by
+// http.NewRequestWithContext(ctx, args) when a context is in scope.
+// It reports whether call was changed.
+func addRequestContext(call *dst.CallExpr, sc *scope) bool {
+	if sc.ctx == nil || !isCallTo(call, "net/http", "NewRequest") {
+		return false
+	}
+	call.Fun = &dst.Ident{Name: "NewRequestWithContext", Path: "net/http"}
+	call.Args = append([]dst.Expr{sc.contextExpr()}, call.Args...)
+	return true
+}
+
+// unwrapClientCall reverts reportClientCalls and addRequestContext, to be used in dst.Inspect.
+// They only rewrite the calls of the statement itself: the calls in its nested blocks, e.g.
+// the body of an if statement whose init is reported, are left as written.
+func unwrapClientCall(n dst.Node) bool {
+	switch n.(type) {
+	case dst.Stmt, dst.Decl:
+	default:
+		return true
+	}
+	dst.Inspect(n, func(n dst.Node) bool {
+		switch n := n.(type) {
+		case *dst.BlockStmt:
+			return false
+		case *dst.CallExpr:
+			unwrapClientCallExpr(n)
+		}
+		return true
+	})
+	return false
+}
+
+// unwrapClientCallExpr reverts the rewrite of call by reportClientCalls or addRequestContext.
+func unwrapClientCallExpr(call *dst.CallExpr) {
+	if isCallTo(call, "net/http", "NewRequestWithContext") && len(call.Args) > 0 {
+		call.Fun = &dst.Ident{Name: "NewRequest", Path: "net/http"}
+		call.Args = call.Args[1:]
+		return
+	}
+	for name, fn := range clientFunctions {
+		if !isCallTo(call, rules.RuntimePackage, fn) {
+			continue
+		}
+		args := call.Args
+		if name != "Do" {
+			if len(args) < 2 {
+				return
+			}
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			return
+		}
+		client := args[0]
+		if u, ok := client.(*dst.UnaryExpr); ok && u.Op == token.AND {
+			client = u.X
+		}
+		if id, ok := client.(*dst.Ident); ok && id.Name == "nil" && id.Path == "" {
+			call.Fun = &dst.Ident{Name: name, Path: "net/http"}
+		} else {
+			call.Fun = &dst.SelectorExpr{X: client, Sel: &dst.Ident{Name: name}}
+		}
+		call.Args = args[1:]
+		return
+	}
+}
+
+// wrapClientLiterals wraps the &http.Client{...} literals of node with
+// instrument.WrapHTTPClient, wherever they appear: struct fields, call arguments,
+// results or variables. It reports whether node was changed.
+func wrapClientLiterals(node dst.Node) bool {
+	changed := false
+	dstutil.Apply(node, func(c *dstutil.Cursor) bool {
+		switch n := c.Node().(type) {
+		case *dst.CallExpr:
+			// already wrapped
+			return !isCallTo(n, rules.RuntimePackage, "WrapHTTPClient")
+		case *dst.UnaryExpr:
+			if !isClientLiteral(n) {
+				return true
+			}
+			call := &dst.CallExpr{
+				Fun:  &dst.Ident{Name: "WrapHTTPClient", Path: rules.RuntimePackage},
+				Args: []dst.Expr{n},
+			}
+			call.Decs.NodeDecs, n.Decs.NodeDecs = n.Decs.NodeDecs, dst.NodeDecs{}
+			c.Replace(call)
+			changed = true
+			return false
+		}
+		return true
+	}, nil)
+	return changed
+}
+
+// isClientLiteral reports whether expr is a &http.Client{...} literal.
+func isClientLiteral(expr dst.Expr) bool {
+	u, ok := expr.(*dst.UnaryExpr)
+	if !ok || u.Op != token.AND {
+		return false
+	}
+	lit, ok := u.X.(*dst.CompositeLit)
+	if !ok {
+		return false
+	}
+	t, ok := lit.Type.(*dst.Ident)
+	return ok && t.Path == "net/http" && t.Name == "Client"
+}
+
+// unwrapClientLiteral reverts wrapClientLiterals, to be used in dst.Inspect.
+func unwrapClientLiteral(n dst.Node) bool {
+	switch n.(type) {
+	case dst.Stmt, dst.Decl:
+	default:
+		return true
+	}
+	dstutil.Apply(n, func(c *dstutil.Cursor) bool {
+		call, ok := c.Node().(*dst.CallExpr)
+		if ok && isCallTo(call, rules.RuntimePackage, "WrapHTTPClient") && len(call.Args) == 1 && isClientLiteral(call.Args[0]) {
+			lit := call.Args[0]
+			lit.Decorations().Before, lit.Decorations().After = call.Decs.Before, call.Decs.After
+			lit.Decorations().Start.Prepend(call.Decs.Start...)
+			lit.Decorations().End.Append(call.Decs.End...)
+			c.Replace(lit)
+		}
+		return true
+	}, nil)
+	return false
+}
+
+// wrapDefaultClient returns the statement wrapping http.DefaultClient, run by main.
+func wrapDefaultClient() dst.Stmt {
+	return &dst.AssignStmt{
+		Lhs: []dst.Expr{&dst.Ident{Name: "DefaultClient", Path: "net/http"}},
+		Tok: token.ASSIGN,
+		Rhs: []dst.Expr{&dst.CallExpr{
+			Fun:  &dst.Ident{Name: "WrapHTTPClient", Path: rules.RuntimePackage},
+			Args: []dst.Expr{&dst.Ident{Name: "DefaultClient", Path: "net/http"}},
+		}},
+	}
+}
@@ -0,0 +1,181 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package instrument
+
+import (
+	"go/build"
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jonbodner/orchestrion/internal/config"
+	"github.com/jonbodner/orchestrion/internal/typechecker"
+)
+
+// generated matches the comment marking generated files, see https://go.dev/s/generatedcode.
+var generated = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// IsGenerated reports whether the source src of the file name is generated code,
+// e.g. by protoc: it has a // Code generated ... DO NOT EDIT. comment before its
+// package clause. Generated files are never instrumented.
+func IsGenerated(name string, src []byte) bool {
+	f, err := parser.ParseFile(token.NewFileSet(), name, src, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return false
+	}
+	for _, g := range f.Comments {
+		if g.Pos() > f.Package {
+			break
+		}
+		for _, c := range g.List {
+			if generated.MatchString(c.Text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// skipDir reports whether the files of the directory name are left alone: vendored
+// code, test data, and the directories ignored by the go command, whose names start
+// with . or _.
+func skipDir(name string) bool {
+	return name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// The GOOS and GOARCH values known to the go command, which select files like build tags.
+var (
+	knownOS = map[string]bool{
+		"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true, "hurd": true,
+		"illumos": true, "ios": true, "js": true, "linux": true, "nacl": true, "netbsd": true, "openbsd": true,
+		"plan9": true, "solaris": true, "wasip1": true, "windows": true, "zos": true,
+	}
+	knownArch = map[string]bool{
+		"386": true, "amd64": true, "amd64p32": true, "arm": true, "armbe": true, "arm64": true, "arm64be": true,
+		"loong64": true, "mips": true, "mipsle": true, "mips64": true, "mips64le": true, "mips64p32": true,
+		"mips64p32le": true, "ppc": true, "ppc64": true, "ppc64le": true, "riscv": true, "riscv64": true,
+		"s390": true, "s390x": true, "sparc": true, "sparc64": true, "wasm": true,
+	}
+)
+
+// maxVariantTags bounds the number of build tags combined to find the build of a file.
+const maxVariantTags = 6
+
+// buildOf returns the build selected by conf, completed with the environment.
+func buildOf(conf config.Config) typechecker.Build {
+	b := typechecker.Build{GOOS: conf.GOOS, GOARCH: conf.GOARCH, Tags: conf.BuildTags}
+	if b.GOOS == "" {
+		b.GOOS = build.Default.GOOS
+	}
+	if b.GOARCH == "" {
+		b.GOARCH = build.Default.GOARCH
+	}
+	return b
+}
+
+// matchBuild reports whether the file name belongs to the build b, after its name,
+// e.g. x_windows.go, and its //go:build constraint.
+func matchBuild(b typechecker.Build, name string) bool {
+	ctx := build.Default
+	ctx.GOOS, ctx.GOARCH, ctx.BuildTags = b.GOOS, b.GOARCH, b.Tags
+	ok, err := ctx.MatchFile(filepath.Dir(name), filepath.Base(name))
+	return err == nil && ok
+}
+
+// variantOf returns the build of the file name, with the source src, when it doesn't
+// belong to base: the first variant of base selecting it, trying the platforms and
+// tags its name and constraint refer to. The files of no build, e.g. //go:build ignore,
+// have none.
+func variantOf(base typechecker.Build, name string, src []byte) (typechecker.Build, bool) {
+	if matchBuild(base, name) {
+		return typechecker.Build{}, false
+	}
+	oses := []string{base.GOOS}
+	arches := []string{base.GOARCH}
+	var tags []string
+	for _, tag := range fileTags(name, src) {
+		switch {
+		case knownOS[tag]:
+			oses = append(oses, tag)
+		case knownArch[tag]:
+			arches = append(arches, tag)
+		case tag != "ignore" && len(tags) < maxVariantTags:
+			tags = append(tags, tag)
+		}
+	}
+	for _, goos := range oses {
+		for _, goarch := range arches {
+			for set := 0; set < 1<<len(tags); set++ {
+				b := typechecker.Build{GOOS: goos, GOARCH: goarch, Tags: append([]string{}, base.Tags...)}
+				for i, tag := range tags {
+					if set&(1<<i) != 0 {
+						b.Tags = append(b.Tags, tag)
+					}
+				}
+				if matchBuild(b, name) {
+					return b, true
+				}
+			}
+		}
+	}
+	return typechecker.Build{}, false
+}
+
+// fileTags returns the build tags the file name refers to, in its name and in its
+// build constraints, in order and without duplicates.
+func fileTags(name string, src []byte) []string {
+	var out []string
+	seen := map[string]bool{}
+	add := func(tag string) {
+		if !seen[tag] {
+			seen[tag] = true
+			out = append(out, tag)
+		}
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(name), ".go"), "_test")
+	for _, elem := range strings.Split(base, "_")[1:] {
+		if knownOS[elem] || knownArch[elem] {
+			add(elem)
+		}
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), name, src, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return out
+	}
+	for _, g := range f.Comments {
+		if g.Pos() > f.Package {
+			break
+		}
+		for _, c := range g.List {
+			if !constraint.IsGoBuild(c.Text) && !constraint.IsPlusBuild(c.Text) {
+				continue
+			}
+			if expr, err := constraint.Parse(c.Text); err == nil {
+				exprTags(expr, add)
+			}
+		}
+	}
+	return out
+}
+
+// exprTags calls add with the tags of the constraint expr.
+func exprTags(expr constraint.Expr, add func(string)) {
+	switch expr := expr.(type) {
+	case *constraint.TagExpr:
+		add(expr.Tag)
+	case *constraint.NotExpr:
+		exprTags(expr.X, add)
+	case *constraint.AndExpr:
+		exprTags(expr.X, add)
+		exprTags(expr.Y, add)
+	case *constraint.OrExpr:
+		exprTags(expr.X, add)
+		exprTags(expr.Y, add)
+	}
+}
@@ -11,20 +11,18 @@ import (
 	"go/parser"
 	"go/token"
 	"io"
-	"io/fs"
 	"log"
-	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/jonbodner/orchestrion/instrument/event"
 	"github.com/jonbodner/orchestrion/internal/config"
+	"github.com/jonbodner/orchestrion/internal/rules"
 	"github.com/jonbodner/orchestrion/internal/typechecker"
 
 	"github.com/dave/dst"
 	"github.com/dave/dst/decorator"
-	"github.com/dave/dst/decorator/resolver/goast"
-	"github.com/dave/dst/decorator/resolver/guess"
+	"github.com/dave/dst/dstutil"
 )
 
 type ProcessFunc func(string, io.Reader, config.Config) (io.Reader, error)
@@ -32,47 +30,55 @@ type ProcessFunc func(string, io.Reader, config.Config) (io.Reader, error)
 type OutputFunc func(string, io.Reader)
 
 func ProcessPackage(name string, process ProcessFunc, output OutputFunc, conf config.Config) error {
-	fileSystem := os.DirFS(name)
-	return fs.WalkDir(fileSystem, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return fmt.Errorf("couldn't walk path: %w", err)
-		}
-		if d.IsDir() || filepath.Ext(path) != ".go" {
-			return nil
-		}
-		fullFileName := name + string(os.PathSeparator) + path
-		file, err := os.Open(fullFileName)
-		if err != nil {
-			return fmt.Errorf("error opening file: %w", err)
-		}
-		out, err := process(path, file, conf)
-		file.Close()
-		if err != nil {
-			return fmt.Errorf("error scanning file %s: %w", path, err)
-		}
-		if out != nil {
-			output(fullFileName, out)
-		}
-		return nil
-	})
+	p := newProcessor(process, output, conf)
+	// Load every package of the tree once, so that each file is type checked
+	// along with the rest of its package and its module dependencies.
+	if err := typechecker.LoadBuild(p.base, name, "./..."); err != nil {
+		log.Printf("Type information unavailable, files will be checked in isolation: %v", err)
+	}
+	return p.walk(name)
 }
 
 func InstrumentFile(name string, content io.Reader, conf config.Config) (io.Reader, error) {
+	src, err := io.ReadAll(content)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", name, err)
+	}
+	// Without the http integration, neither handlers nor clients are instrumented.
+	if !conf.Enabled(rules.HTTPIntegration) {
+		conf.HTTPMode = ""
+	}
 	fset := token.NewFileSet()
-	astFile, err := parser.ParseFile(fset, name, content, parser.ParseComments)
+	astFile, err := parser.ParseFile(fset, name, src, parser.ParseComments)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing content in %s: %w", name, err)
 	}
 
-	dec := decorator.NewDecoratorWithImports(fset, name, goast.New())
+	dec := decorator.NewDecoratorWithImports(fset, name, newIdentResolver())
 	f, err := dec.DecorateFile(astFile)
 	if err != nil {
 		return nil, fmt.Errorf("error decorating file %s: %w", name, err)
 	}
+	ds := readDirectives(f, conf)
+
+	// A file instrumented with another configuration is converted: its instrumentation
+	// is removed before instrumenting it again, which avoids e.g. wrapped handlers
+	// reporting their requests too.
+	if from, ok := conflictingMarkers(f, conf); ok {
+		log.Printf("%s was instrumented with %s, converting it", name, from)
+		orig, err := UninstrumentFile(name, bytes.NewReader(src), conf)
+		if err != nil {
+			return nil, fmt.Errorf("error converting %s from %s: %w", name, from, err)
+		}
+		return InstrumentFile(name, orig, conf)
+	}
+	if outdatedMarkers(f) {
+		log.Printf("%s was instrumented by an older version of orchestrion, run orchestrion upgrade", name)
+	}
 
 	// Use the type checker to extract variable types
 	tc := typechecker.New(dec)
-	tc.Check(name, fset, astFile)
+	tc.Check(name, src, fset, astFile)
 	hasMain := false
 	hasConstant := false
 	for _, decl := range f.Decls {
@@ -89,6 +95,10 @@ func InstrumentFile(name string, content io.Reader, conf config.Config) (io.Read
 				if hasConstant {
 					continue
 				}
+				if conf.HTTPMode == "wrap" && !hasLabel(dd_startwrap, decs.All()) && wrapClientLiterals(decl) {
+					decl.Decs.Start.Append(withMode(dd_startwrap, conf.HTTPMode))
+					decl.Decs.End.Append("\n", dd_endwrap)
+				}
 			}
 		}
 
@@ -102,26 +112,33 @@ func InstrumentFile(name string, content io.Reader, conf config.Config) (io.Read
 			// find magic comments on functions
 			for _, v := range decl.Decorations().Start.All() {
 				if strings.HasPrefix(v, dd_span) {
-					decl = addSpanCodeToFunction(v, decl, tc)
+					decl = addSpanCodeToFunction(v, decl, tc, conf)
 					break
 				}
 			}
 			// add init to main
 			if decl.Name.Name == "main" {
 				hasMain = true
-				decl = addInit(decl)
+				decl = addInit(decl, conf)
 			}
 			// wrap or report clients and handlers
-			decl.Body.List = addInFunctionCode(decl.Body.List, tc, conf)
+			decl.Body.List = addInFunctionCode(decl.Body.List, tc, conf, declScope(decl, tc, conf))
 		}
 	}
 	if hasMain && !hasConstant {
 		f.Decls = append(f.Decls, addInitVar(conf))
 	}
+	if conf.LineDirectives {
+		addLineDirectives(name, f, dec)
+	}
+	ds.write(f, conf)
 
-	res := decorator.NewRestorerWithImports(name, guess.New())
+	res := decorator.NewRestorerWithImports(name, packageNames{})
 	var out bytes.Buffer
 	err = res.Fprint(&out, f)
+	if conf.LineDirectives {
+		return bytes.NewReader(fixLineDirectives(out.Bytes())), err
+	}
 	return &out, err
 }
 
@@ -143,14 +160,14 @@ func addInitVar(conf config.Config) dst.Decl {
 		Rparen: false,
 		Decs: dst.GenDeclDecorations{
 			NodeDecs: dst.NodeDecs{
-				Start: dst.Decorations{"\n", dd_startinstrument},
+				Start: dst.Decorations{"\n", withTarget(dd_startinstrument, conf.Instrumentation)},
 				End:   dst.Decorations{"\n", dd_endinstrument},
 			},
 		},
 	}
 }
 
-func addSpanCodeToFunction(comment string, decl *dst.FuncDecl, tc *typechecker.TypeChecker) *dst.FuncDecl {
+func addSpanCodeToFunction(comment string, decl *dst.FuncDecl, tc *typechecker.TypeChecker, conf config.Config) *dst.FuncDecl {
 	//check if magic comment is attached to first line
 	if len(decl.Body.List) > 0 {
 		decs := decl.Body.List[0].Decorations().Start
@@ -171,94 +188,192 @@ func addSpanCodeToFunction(comment string, decl *dst.FuncDecl, tc *typechecker.T
 
 	// get function name
 	funcName := decl.Name.String()
-	// get context parameter
-	var ci contextInfo
-	if len(decl.Type.Params.List) > 0 {
-		// first see if the 1st parameter of the function is a context. If so, use it
-		firstField := decl.Type.Params.List[0]
-		if isType(firstField.Type, "context", "Context") {
-			name := "ctx"
-			path := ""
-			if len(firstField.Names) > 0 {
-				name = firstField.Names[0].Name
-				path = firstField.Names[0].Path
-			}
-			ci = contextInfo{contextType: ident, name: name, path: path}
-		} else {
-			// if not, see if there's an *http.Request parameter. If so, use r.Context()
-			for _, v := range decl.Type.Params.List {
-				if tc.OfType(v.Type, "*net/http.Request") {
-					name := "req"
-					path := ""
-					if len(v.Names) > 0 {
-						name = v.Names[0].Name
-						path = v.Names[0].Path
-					}
-					ci = contextInfo{contextType: call, name: name, path: path}
-					break
-				}
-			}
-		}
-	}
-	// if no context, cannot use the span comment
-	if ci.contextType == 0 {
-		log.Println("no context in function parameters, cannot instrument", funcName)
-		return decl
-	}
+	parts = checkSpanTags(funcName, parts, decl.Type.Params, tc)
+	ci := findContext(funcName, decl.Type.Params, tc, conf)
+	errName := nameErrorResult(decl.Type)
 	newLines := buildSpanInstrumentation(ci,
 		parts,
-		funcName)
+		conf.SpanName(funcName),
+		errName,
+		conf)
 	decl.Body.List = append(newLines, decl.Body.List...)
 	return decl
 }
 
+// orchestrionErr names the error result of the functions with a span, when it has no name.
+const orchestrionErr = "orchestrionErr"
+
+// nameErrorResult returns the name of the last result of the function, if it is an error.
+// Unnamed results are named, so that the error can be reported when the function returns:
+// the error is named orchestrionErr, and the other results _.
+func nameErrorResult(ft *dst.FuncType) string {
+	if ft.Results == nil || len(ft.Results.List) == 0 {
+		return ""
+	}
+	last := ft.Results.List[len(ft.Results.List)-1]
+	if typ, ok := last.Type.(*dst.Ident); !ok || typ.Name != "error" || typ.Path != "" {
+		return ""
+	}
+	if len(last.Names) == 0 {
+		for _, field := range ft.Results.List {
+			field.Names = []*dst.Ident{dst.NewIdent("_")}
+		}
+		last.Names[0].Name = orchestrionErr
+		return orchestrionErr
+	}
+	name := last.Names[len(last.Names)-1]
+	if name.Name == "_" {
+		name.Name = orchestrionErr
+	}
+	return name.Name
+}
+
+// unnameErrorResult reverts nameErrorResult.
+func unnameErrorResult(ft *dst.FuncType) {
+	if ft.Results == nil || len(ft.Results.List) == 0 {
+		return
+	}
+	last := ft.Results.List[len(ft.Results.List)-1]
+	if len(last.Names) == 0 || last.Names[len(last.Names)-1].Name != orchestrionErr {
+		return
+	}
+	last.Names[len(last.Names)-1].Name = "_"
+	for _, field := range ft.Results.List {
+		for _, name := range field.Names {
+			if name.Name != "_" {
+				return
+			}
+		}
+	}
+	for _, field := range ft.Results.List {
+		field.Names = nil
+	}
+}
+
 type contextType int
 
 const (
 	_ contextType = iota
+	// ident is a context.Context parameter.
 	ident
-	call
+	// accessor is a parameter holding a context, described by a rules.Context.
+	accessor
+	// background means there is no context: a root span is started from context.Background().
+	background
 )
 
 type contextInfo struct {
 	contextType contextType
 	name        string
 	path        string
+	ctx         rules.Context
+}
+
+// orchestrionCtx names the context of the root spans, and stands for the new context in
+// the Set statements of the context accessors.
+const orchestrionCtx = "orchestrionCtx"
+
+// findContext returns the context used by the span of the function funcName.
+// It is the first parameter if it is a context.Context, or else the first parameter
+// holding a context, according to the context accessors of conf and to rules.BuiltinContexts.
+// Without such a parameter, the span is a root span.
+func findContext(funcName string, params *dst.FieldList, tc *typechecker.TypeChecker, conf config.Config) contextInfo {
+	if len(params.List) > 0 && len(params.List[0].Names) == 0 && isType(params.List[0].Type, "context", "Context") {
+		return contextInfo{contextType: ident, name: "ctx"}
+	}
+	if ci, ok := paramContext(params, tc, conf); ok {
+		return ci
+	}
+	log.Printf("warning: no context in function parameters, starting a root span in %s", funcName)
+	return contextInfo{contextType: background}
+}
+
+// paramContext returns the context held by the named parameters in params, if any.
+func paramContext(params *dst.FieldList, tc *typechecker.TypeChecker, conf config.Config) (contextInfo, bool) {
+	if len(params.List) > 0 {
+		// first see if the 1st parameter of the function is a context. If so, use it
+		firstField := params.List[0]
+		if len(firstField.Names) > 0 && firstField.Names[0].Name != "_" && isType(firstField.Type, "context", "Context") {
+			return contextInfo{contextType: ident, name: firstField.Names[0].Name, path: firstField.Names[0].Path}, true
+		}
+	}
+	// if not, see if a parameter holds a context, e.g. an *http.Request. If so, use r.Context()
+	ctxs := append(append([]rules.Context{}, conf.Contexts...), rules.BuiltinContexts...)
+	for _, field := range params.List {
+		if len(field.Names) == 0 || field.Names[0].Name == "_" {
+			continue
+		}
+		for _, c := range ctxs {
+			if isParamType(field.Type, c.Type, tc) {
+				return contextInfo{contextType: accessor, name: field.Names[0].Name, path: field.Names[0].Path, ctx: c}, true
+			}
+		}
+	}
+	return contextInfo{}, false
+}
+
+// isParamType reports whether the parameter type expr is typ, e.g. *net/http.Request.
+// Without type information, typ is compared with the type expression itself.
+func isParamType(expr dst.Expr, typ string, tc *typechecker.TypeChecker) bool {
+	if tc.OfType(expr, typ) {
+		return true
+	}
+	name := typ
+	if star, ok := expr.(*dst.StarExpr); ok {
+		if name, ok = strings.CutPrefix(typ, "*"); !ok {
+			return false
+		}
+		expr = star.X
+	}
+	i := strings.LastIndex(name, ".")
+	id, ok := expr.(*dst.Ident)
+	return ok && i > 0 && id.Path == name[:i] && id.Name == name[i+1:]
 }
 
-func buildSpanInstrumentation(contextExpr contextInfo, parts []string, name string) []dst.Stmt {
+func buildSpanInstrumentation(contextExpr contextInfo, parts []string, name string, errName string, conf config.Config) []dst.Stmt {
 	/*
 		lines to insert:
 			//dd:startinstrument
 			contextIdent = Report(contextIdent, EventStart, "name", "doThing", parts...)
 			defer Report(contextIdent, EventEnd, "name", "doThing", parts...)
 			//dd:endinstrument
+		when the function returns an error named errName, the end event reports it:
+			defer func() {
+				Report(contextIdent, EventEnd, "name", "doThing", parts..., "error", errName)
+			}()
+		when the context is held by a parameter, it is replaced using its accessor, e.g.:
+			r = r.WithContext(Report(r.Context(), EventStart, "name", "doThing", parts...))
+			defer Report(r.Context(), EventEnd, "name", "doThing", parts...)
+		without context, a root span is started:
+			orchestrionCtx := Report(context.Background(), EventStart, "name", "doThing", parts...)
+			defer Report(orchestrionCtx, EventEnd, "name", "doThing", parts...)
 	*/
-	if contextExpr.contextType != ident {
+	endCall := &dst.CallExpr{
+		Fun:  &dst.Ident{Name: "Report", Path: "github.com/jonbodner/orchestrion/instrument"},
+		Args: buildArgs(contextExpr, event.EventEnd, name, parts),
+	}
+	if errName != "" {
+		endCall.Args = append(endCall.Args,
+			&dst.BasicLit{Kind: token.STRING, Value: `"error"`},
+			&dst.Ident{Name: errName},
+		)
+	}
+	startCall := &dst.CallExpr{
+		Fun:  &dst.Ident{Name: "Report", Path: "github.com/jonbodner/orchestrion/instrument"},
+		Args: buildArgs(contextExpr, event.EventStart, name, parts),
+	}
+	start := buildContextStart(contextExpr, startCall)
+	if start == nil || endCall.Args[0] == nil {
 		return nil
 	}
+	start.Decorations().Before = dst.NewLine
+	start.Decorations().Start = dst.Decorations{startMarker(dd_startinstrument)}
+	start.Decorations().After = dst.NewLine
 
 	newLines := []dst.Stmt{
-		&dst.AssignStmt{
-			Lhs: []dst.Expr{&dst.Ident{Name: contextExpr.name}},
-			Tok: token.ASSIGN,
-			Rhs: []dst.Expr{
-				&dst.CallExpr{
-					Fun:  &dst.Ident{Name: "Report", Path: "github.com/jonbodner/orchestrion/instrument"},
-					Args: buildArgs(contextExpr, event.EventStart, name, parts),
-				},
-			},
-			Decs: dst.AssignStmtDecorations{NodeDecs: dst.NodeDecs{
-				Before: dst.NewLine,
-				Start:  dst.Decorations{dd_startinstrument},
-				After:  dst.NewLine,
-			}},
-		},
+		start,
 		&dst.DeferStmt{
-			Call: &dst.CallExpr{
-				Fun:  &dst.Ident{Name: "Report", Path: "github.com/jonbodner/orchestrion/instrument"},
-				Args: buildArgs(contextExpr, event.EventEnd, name, parts),
-			},
+			Call: deferredEnd(endCall, errName != "", conf),
 			Decs: dst.DeferStmtDecorations{NodeDecs: dst.NodeDecs{
 				After: dst.NewLine,
 				End:   dst.Decorations{"\n", dd_endinstrument},
@@ -268,6 +383,74 @@ func buildSpanInstrumentation(contextExpr contextInfo, parts []string, name stri
 	return newLines
 }
 
+// buildContextStart returns the statement storing the context returned by start, the call
+// reporting the start event.
+func buildContextStart(in contextInfo, start *dst.CallExpr) dst.Stmt {
+	switch in.contextType {
+	case ident:
+		return &dst.AssignStmt{
+			Lhs: []dst.Expr{&dst.Ident{Name: in.name}},
+			Tok: token.ASSIGN,
+			Rhs: []dst.Expr{start},
+		}
+	case accessor:
+		stmt, err := parseContextCode(in.ctx.Expand(in.ctx.Set, in.name, orchestrionCtx))
+		if err != nil {
+			log.Printf("context %s: invalid set: %v", in.ctx.Type, err)
+			return nil
+		}
+		dstutil.Apply(stmt, nil, func(c *dstutil.Cursor) bool {
+			if id, ok := c.Node().(*dst.Ident); ok && id.Name == orchestrionCtx {
+				c.Replace(start)
+			}
+			return true
+		})
+		return stmt
+	case background:
+		start.Args[0] = &dst.CallExpr{Fun: &dst.Ident{Name: "Background", Path: "context"}}
+		return &dst.AssignStmt{
+			Lhs: []dst.Expr{&dst.Ident{Name: orchestrionCtx}},
+			Tok: token.DEFINE,
+			Rhs: []dst.Expr{start},
+		}
+	}
+	panic(fmt.Sprintf("unexpected contextInfo %#v", in))
+}
+
+// parseContextCode parses a statement of a context accessor.
+func parseContextCode(src string) (dst.Stmt, error) {
+	f, err := decorator.Parse("package p\n\nfunc _() {\n" + src + "\n}\n")
+	if err != nil {
+		return nil, err
+	}
+	body := f.Decls[0].(*dst.FuncDecl).Body
+	if len(body.List) != 1 {
+		return nil, fmt.Errorf("%q is not a single statement", src)
+	}
+	stmt := body.List[0]
+	stmt.Decorations().Before = dst.None
+	stmt.Decorations().After = dst.None
+	return stmt, nil
+}
+
+// deferredEnd returns the call to defer for the end event reported by report.
+// The event is reported from a closure when it reads the results of the function, or when
+// panics are recorded: recover only stops a panic when called by the deferred function.
+func deferredEnd(report *dst.CallExpr, readsResults bool, conf config.Config) *dst.CallExpr {
+	if conf.RecordPanics {
+		report.Fun = &dst.Ident{Name: "ReportPanic", Path: "github.com/jonbodner/orchestrion/instrument"}
+		report.Args = append([]dst.Expr{report.Args[0], &dst.CallExpr{Fun: &dst.Ident{Name: "recover"}}}, report.Args[1:]...)
+	} else if !readsResults {
+		return report
+	}
+	return &dst.CallExpr{
+		Fun: &dst.FuncLit{
+			Type: &dst.FuncType{Params: &dst.FieldList{}},
+			Body: &dst.BlockStmt{List: []dst.Stmt{&dst.ExprStmt{X: report}}},
+		},
+	}
+}
+
 func buildArgs(contextExpr contextInfo, event event.Event, name string, parts []string) []dst.Expr {
 	out := make([]dst.Expr, 0, len(parts)*2+4)
 	out = append(out,
@@ -281,18 +464,21 @@ func buildArgs(contextExpr contextInfo, event event.Event, name string, parts []
 	return out
 }
 
+// dupCtxExprForSpan returns the expression of the context of the span.
+// It returns nil when the Get expression of a context accessor is invalid.
 func dupCtxExprForSpan(in contextInfo) dst.Expr {
-	// only expecting r.Context() or ctx
 	switch in.contextType {
-	case call:
-		return &dst.CallExpr{
-			Fun: &dst.SelectorExpr{
-				X:   &dst.Ident{Name: in.name, Path: in.path},
-				Sel: &dst.Ident{Name: "Context"},
-			},
-		}
 	case ident:
 		return &dst.Ident{Name: in.name, Path: in.path}
+	case accessor:
+		stmt, err := parseContextCode("_ = " + in.ctx.Expand(in.ctx.Get, in.name, orchestrionCtx))
+		if err != nil {
+			log.Printf("context %s: invalid get: %v", in.ctx.Type, err)
+			return nil
+		}
+		return stmt.(*dst.AssignStmt).Rhs[0]
+	case background:
+		return &dst.Ident{Name: orchestrionCtx}
 	}
 	panic(fmt.Sprintf("unexpected contextInfo %#v", in))
 }
@@ -302,43 +488,144 @@ func buildExprsFromParts(parts []string) []dst.Expr {
 	for _, v := range parts {
 		key, val, _ := strings.Cut(v, ":")
 		out = append(out, &dst.BasicLit{Kind: token.STRING, Value: `"` + key + `"`})
+		if ref, ok := strings.CutPrefix(val, "$"); ok {
+			// a parameter, or a field of a parameter
+			names := strings.Split(ref, ".")
+			var expr dst.Expr = &dst.Ident{Name: names[0]}
+			for _, name := range names[1:] {
+				expr = &dst.SelectorExpr{X: expr, Sel: &dst.Ident{Name: name}}
+			}
+			out = append(out, expr)
+			continue
+		}
 		out = append(out, &dst.BasicLit{Kind: token.STRING, Value: `"` + val + `"`})
 	}
 	return out
 }
 
+// checkSpanTags returns the tags of a //dd:span comment, without the invalid references.
+// A tag value starting with $ refers to a parameter of the function, or to one of its fields,
+// e.g. $req.UserID. The fields are checked with the type checker, when the type is known.
+func checkSpanTags(funcName string, parts []string, params *dst.FieldList, tc *typechecker.TypeChecker) []string {
+	out := make([]string, 0, len(parts))
+	for _, part := range parts {
+		key, val, _ := strings.Cut(part, ":")
+		ref, ok := strings.CutPrefix(val, "$")
+		if !ok {
+			out = append(out, part)
+			continue
+		}
+		names := strings.Split(ref, ".")
+		valid := true
+		for _, name := range names {
+			valid = valid && token.IsIdentifier(name)
+		}
+		if !valid {
+			log.Printf("%s: invalid value %s for span tag %s", funcName, val, key)
+			continue
+		}
+		param := findParam(params, names[0])
+		if param == nil {
+			log.Printf("%s: no parameter %s for span tag %s", funcName, names[0], key)
+			continue
+		}
+		if err := tc.CheckFields(param, names[1:]); err != nil {
+			log.Printf("%s: invalid value %s for span tag %s: %v", funcName, val, key, err)
+			continue
+		}
+		out = append(out, part)
+	}
+	return out
+}
+
+// findParam returns the identifier of the parameter name, or nil if there is none.
+func findParam(params *dst.FieldList, name string) *dst.Ident {
+	if name == "_" {
+		return nil
+	}
+	for _, field := range params.List {
+		for _, ident := range field.Names {
+			if ident.Name == name {
+				return ident
+			}
+		}
+	}
+	return nil
+}
+
 func skipInstrumentation(stmt dst.Stmt) bool {
 	decos := stmt.Decorations().Start.All()
-	return hasLabel(dd_instrumented, decos) ||
+	if hasLabel(dd_instrumented, decos) ||
 		hasLabel(dd_startinstrument, decos) ||
-		hasLabel(dd_startwrap, decos) ||
-		hasLabel(dd_ignore, decos)
+		hasLabel(dd_ignore, decos) {
+		return true
+	}
+	// The wrap markers of if and switch statements only cover their init statement:
+	// their body is instrumented anyway.
+	switch stmt.(type) {
+	case *dst.IfStmt, *dst.SwitchStmt, *dst.TypeSwitchStmt:
+		return false
+	}
+	return hasLabel(dd_startwrap, decos)
+}
+
+// recordReportedRequest records in sc the request created by stmt, if it is reported
+// by an earlier run: the requests are reported after their creation, marked as
+// //dd:instrumented, and must not be reported again by the calls sending them.
+func recordReportedRequest(stmt dst.Stmt, sc *scope) {
+	assign, ok := stmt.(*dst.AssignStmt)
+	if !ok || !hasLabel(dd_instrumented, assign.Decorations().Start.All()) {
+		return
+	}
+	if requestName, _, ok := analyzeStmtForRequestClient(assign); ok {
+		sc.requests[requestName] = true
+	}
+}
+
+// reportInitCalls reports the client calls made by the init statement of the if
+// or switch statement stmt. The markers surround stmt, as init shares its line.
+func reportInitCalls(stmt, init dst.Stmt, sc *scope, tc *typechecker.TypeChecker, conf config.Config) {
+	if init != nil && conf.HTTPMode == "report" && reportClientCalls(init, sc, tc) {
+		markWrapped(stmt, conf.HTTPMode)
+	}
 }
 
-func addInFunctionCode(list []dst.Stmt, tc *typechecker.TypeChecker, conf config.Config) []dst.Stmt {
+// addInFunctionCode wraps or reports the clients and handlers used by the statements
+// of a function with the scope sc.
+func addInFunctionCode(list []dst.Stmt, tc *typechecker.TypeChecker, conf config.Config, sc *scope) []dst.Stmt {
 	out := make([]dst.Stmt, 0, len(list))
 	for _, stmt := range list {
 		if skipInstrumentation(stmt) {
+			recordReportedRequest(stmt, sc)
 			out = append(out, stmt)
 			continue
 		}
 		appendStmt := true
+		switch stmt.(type) {
+		case *dst.AssignStmt, *dst.DeclStmt, *dst.DeferStmt, *dst.ExprStmt, *dst.GoStmt, *dst.ReturnStmt, *dst.SendStmt:
+			if conf.HTTPMode == "wrap" && wrapClientLiterals(stmt) {
+				markWrapped(stmt, conf.HTTPMode)
+			}
+		}
 		switch stmt := stmt.(type) {
 		case *dst.AssignStmt:
-			switch conf.HTTPMode {
-			case "wrap":
-				wrapFromAssign(stmt)
-			case "report":
-				if requestName, ok := analyzeStmtForRequestClient(stmt); ok {
+			out = append(out, applyRules(stmt, tc, conf)...)
+			if conf.HTTPMode == "report" {
+				if reportClientCalls(stmt, sc, tc) {
+					markWrapped(stmt, conf.HTTPMode)
+				}
+				if requestName, call, ok := analyzeStmtForRequestClient(stmt); ok {
+					if addRequestContext(call, sc) {
+						markWrapped(stmt, conf.HTTPMode)
+					}
 					stmt.Decorations().Start.Prepend(dd_instrumented)
+					sc.requests[requestName] = true
 					out = append(out, stmt)
 					appendStmt = false
 					out = append(out, buildRequestClientCode(requestName))
 				}
 				reportHandlerFromAssign(stmt, tc, conf)
 			}
-			wrapSqlOpenFromAssign(stmt)
-			wrapGRPC(stmt)
 
 			// Recurse when there is a function literal on the RHS of the assignment.
 			for _, expr := range stmt.Rhs {
@@ -346,26 +633,27 @@ func addInFunctionCode(list []dst.Stmt, tc *typechecker.TypeChecker, conf config
 					for _, v := range compLit.Elts {
 						if kv, ok := v.(*dst.KeyValueExpr); ok {
 							if funLit, ok := kv.Value.(*dst.FuncLit); ok {
-								funLit.Body.List = addInFunctionCode(funLit.Body.List, tc, conf)
+								funLit.Body.List = addInFunctionCode(funLit.Body.List, tc, conf, newScope(funLit.Type.Params, sc, tc, conf))
 							}
 						}
 					}
 				}
 				if funLit, ok := expr.(*dst.FuncLit); ok {
-					funLit.Body.List = addInFunctionCode(funLit.Body.List, tc, conf)
+					funLit.Body.List = addInFunctionCode(funLit.Body.List, tc, conf, newScope(funLit.Type.Params, sc, tc, conf))
 				}
 			}
 		case *dst.ExprStmt:
-			switch conf.HTTPMode {
-			case "wrap":
-				wrapHandlerFromExpr(stmt)
-			case "report":
+			out = append(out, applyRules(stmt, tc, conf)...)
+			if conf.HTTPMode == "report" {
+				if reportClientCalls(stmt, sc, tc) {
+					markWrapped(stmt, conf.HTTPMode)
+				}
 				reportHandlerFromExpr(stmt, tc, conf)
 			}
 			if call, ok := stmt.X.(*dst.CallExpr); ok {
 				switch funLit := call.Fun.(type) {
 				case *dst.FuncLit:
-					funLit.Body.List = addInFunctionCode(funLit.Body.List, tc, conf)
+					funLit.Body.List = addInFunctionCode(funLit.Body.List, tc, conf, newScope(funLit.Type.Params, sc, tc, conf))
 				}
 			}
 		case *dst.GoStmt:
@@ -373,9 +661,9 @@ func addInFunctionCode(list []dst.Stmt, tc *typechecker.TypeChecker, conf config
 				if funLit, ok := stmt.Call.Fun.(*dst.FuncLit); ok {
 					// check for function literal that is a handler
 					if analyzeExpressionForHandlerLiteral(funLit, tc) {
-						funLit.Body.List = buildFunctionLiteralHandlerCode(nil, funLit)
+						funLit.Body.List = buildFunctionLiteralHandlerCode(nil, funLit, conf)
 					}
-					funLit.Body.List = addInFunctionCode(funLit.Body.List, tc, conf)
+					funLit.Body.List = addInFunctionCode(funLit.Body.List, tc, conf, newScope(funLit.Type.Params, sc, tc, conf))
 				}
 			}
 		case *dst.DeferStmt:
@@ -383,31 +671,37 @@ func addInFunctionCode(list []dst.Stmt, tc *typechecker.TypeChecker, conf config
 				if funLit, ok := stmt.Call.Fun.(*dst.FuncLit); ok {
 					// check for function literal that is a handler
 					if analyzeExpressionForHandlerLiteral(funLit, tc) {
-						funLit.Body.List = buildFunctionLiteralHandlerCode(nil, funLit)
+						funLit.Body.List = buildFunctionLiteralHandlerCode(nil, funLit, conf)
 					}
-					funLit.Body.List = addInFunctionCode(funLit.Body.List, tc, conf)
+					funLit.Body.List = addInFunctionCode(funLit.Body.List, tc, conf, newScope(funLit.Type.Params, sc, tc, conf))
 				}
 			}
 		case *dst.BlockStmt:
-			stmt.List = addInFunctionCode(stmt.List, tc, conf)
+			stmt.List = addInFunctionCode(stmt.List, tc, conf, sc)
 		case *dst.CaseClause:
-			stmt.Body = addInFunctionCode(stmt.Body, tc, conf)
+			stmt.Body = addInFunctionCode(stmt.Body, tc, conf, sc)
 		case *dst.CommClause:
-			stmt.Body = addInFunctionCode(stmt.Body, tc, conf)
+			stmt.Body = addInFunctionCode(stmt.Body, tc, conf, sc)
 		case *dst.IfStmt:
-			stmt.Body.List = addInFunctionCode(stmt.Body.List, tc, conf)
+			reportInitCalls(stmt, stmt.Init, sc, tc, conf)
+			stmt.Body.List = addInFunctionCode(stmt.Body.List, tc, conf, sc)
 		case *dst.SwitchStmt:
-			stmt.Body.List = addInFunctionCode(stmt.Body.List, tc, conf)
+			reportInitCalls(stmt, stmt.Init, sc, tc, conf)
+			stmt.Body.List = addInFunctionCode(stmt.Body.List, tc, conf, sc)
 		case *dst.TypeSwitchStmt:
-			stmt.Body.List = addInFunctionCode(stmt.Body.List, tc, conf)
+			reportInitCalls(stmt, stmt.Init, sc, tc, conf)
+			stmt.Body.List = addInFunctionCode(stmt.Body.List, tc, conf, sc)
 		case *dst.SelectStmt:
-			stmt.Body.List = addInFunctionCode(stmt.Body.List, tc, conf)
+			stmt.Body.List = addInFunctionCode(stmt.Body.List, tc, conf, sc)
 		case *dst.ForStmt:
-			stmt.Body.List = addInFunctionCode(stmt.Body.List, tc, conf)
+			stmt.Body.List = addInFunctionCode(stmt.Body.List, tc, conf, sc)
 		case *dst.RangeStmt:
-			stmt.Body.List = addInFunctionCode(stmt.Body.List, tc, conf)
+			stmt.Body.List = addInFunctionCode(stmt.Body.List, tc, conf, sc)
 		case *dst.ReturnStmt:
-			stmt = instrumentReturn(stmt)
+			out = append(out, applyRules(stmt, tc, conf)...)
+			if conf.HTTPMode == "report" && reportClientCalls(stmt, sc, tc) {
+				markWrapped(stmt, conf.HTTPMode)
+			}
 		}
 		if appendStmt {
 			out = append(out, stmt)
@@ -416,11 +710,7 @@ func addInFunctionCode(list []dst.Stmt, tc *typechecker.TypeChecker, conf config
 	return out
 }
 
-func instrumentReturn(stmt *dst.ReturnStmt) *dst.ReturnStmt {
-	return wrapSqlReturnCall(stmt)
-}
-
-func buildFunctionLiteralHandlerCode(name dst.Expr, funLit *dst.FuncLit) []dst.Stmt {
+func buildFunctionLiteralHandlerCode(name dst.Expr, funLit *dst.FuncLit, conf config.Config) []dst.Stmt {
 	//check if magic comment is attached to first line
 	if len(funLit.Body.List) > 0 {
 		decs := funLit.Body.List[0].Decorations().Start
@@ -437,7 +727,7 @@ func buildFunctionLiteralHandlerCode(name dst.Expr, funLit *dst.FuncLit) []dst.S
 	if len(names) > 0 {
 		requestName = names[0].Name
 	}
-	newLines := buildFunctionInstrumentation(name, requestName)
+	newLines := buildFunctionInstrumentation(name, requestName, conf)
 	funLit.Body.List = append(newLines, funLit.Body.List...)
 	return funLit.Body.List
 }
@@ -469,235 +759,23 @@ func hasLabel(label string, decs []string) bool {
 	return false
 }
 
-func analyzeStmtForRequestClient(stmt *dst.AssignStmt) (string, bool) {
+func analyzeStmtForRequestClient(stmt *dst.AssignStmt) (string, *dst.CallExpr, bool) {
 	// looking for
 	// 	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "localhost:8080", strings.NewReader(os.Args[1]))
+	// or
+	// 	req, err := http.NewRequest(http.MethodPost, "localhost:8080", strings.NewReader(os.Args[1]))
 	// has 2 return values (*http.Request and error)
-	// function named NewRequestWithContext
 	if len(stmt.Lhs) == 2 &&
 		len(stmt.Rhs) == 1 {
 		if fun, ok := stmt.Rhs[0].(*dst.CallExpr); ok {
-			if iden, ok := fun.Fun.(*dst.Ident); ok {
-				if iden.Name == "NewRequestWithContext" && iden.Path == "net/http" {
-					if iden, ok := stmt.Lhs[0].(*dst.Ident); ok {
-						return iden.Name, true
-					}
-				}
-			}
-		}
-	}
-	return "", false
-}
-
-func wrapFromAssign(stmt *dst.AssignStmt) bool {
-	return wrapHandlerFromAssign(stmt) || wrapClientFromAssign(stmt)
-
-}
-
-func wrapGRPC(stmt *dst.AssignStmt) {
-	/*
-		//dd:startwrap
-		s := grpc.NewServer(opt1, opt2, orchestrion.GRPCStreamServerInterceptor(), orchestrion.GRPCUnaryServerInterceptor())
-		//dd:endwrap
-	*/
-
-	/*
-		//dd:startwrap
-		c, err := grpc.Dial(target, opt1, orchestrion.GRPCStreamClientInterceptor(), orchestrion.GRPCUnaryClientInterceptor())
-		//dd:endwrap
-	*/
-	if !(len(stmt.Lhs) <= 2 && len(stmt.Rhs) == 1) {
-		return
-	}
-	wrap := func(targetName string, opts ...string) {
-		if fun, ok := stmt.Rhs[0].(*dst.CallExpr); ok {
-			if iden, ok := fun.Fun.(*dst.Ident); ok {
-				if !(iden.Name == targetName && iden.Path == "google.golang.org/grpc") {
-					return
-				}
-				stmt.Decorations().Start.Append(dd_startwrap)
-				stmt.Decorations().End.Append("\n", dd_endwrap)
-				for _, opt := range opts {
-					fun.Args = append(fun.Args,
-						&dst.CallExpr{Fun: &dst.Ident{Name: opt, Path: "github.com/jonbodner/orchestrion/instrument"}},
-					)
-				}
-			}
-		}
-	}
-	wrap("NewServer", "GRPCStreamServerInterceptor", "GRPCUnaryServerInterceptor")
-	wrap("Dial", "GRPCStreamClientInterceptor", "GRPCUnaryClientInterceptor")
-}
-
-func wrapHandlerFromAssign(stmt *dst.AssignStmt) bool {
-	/*
-		s = &http.Server{
-			//dd:startwrap
-			Handler: orchestrion.WrapHandler(handler),
-			//dd:endwrap
-		}
-	*/
-	if !(len(stmt.Lhs) == 1 && len(stmt.Rhs) == 1) {
-		return false
-	}
-	if uexpr, ok := stmt.Rhs[0].(*dst.UnaryExpr); ok {
-		if x, ok := uexpr.X.(*dst.CompositeLit); ok {
-			t, ok := x.Type.(*dst.Ident)
-			if !(ok && t.Path == "net/http" && t.Name == "Server") {
-				return false
-			}
-			for _, e := range x.Elts {
-				if hasLabel(dd_startwrap, e.Decorations().Start.All()) {
-					return false
+			if isCallTo(fun, "net/http", "NewRequestWithContext") || isCallTo(fun, "net/http", "NewRequest") {
+				if iden, ok := stmt.Lhs[0].(*dst.Ident); ok && iden.Name != "_" {
+					return iden.Name, fun, true
 				}
-				if kve, ok := e.(*dst.KeyValueExpr); ok {
-					k, ok := kve.Key.(*dst.Ident)
-					if !(ok && k.Name == "Handler") {
-						continue
-					}
-					kve.Decorations().Start.Append(dd_startwrap)
-					kve.Decorations().End.Append("\n", dd_endwrap)
-					kve.Value = &dst.CallExpr{
-						Fun:  &dst.Ident{Name: "WrapHandler", Path: "github.com/jonbodner/orchestrion/instrument"},
-						Args: []dst.Expr{kve.Value},
-					}
-					return true
-				}
-			}
-		}
-	}
-	return false
-}
-
-func wrapClientFromAssign(stmt *dst.AssignStmt) bool {
-	/*
-		//dd:startwrap
-		c = orchestrion.WrapHTTPClient(client)
-		//dd:endwrap
-	*/
-	if !(len(stmt.Lhs) == 1 && len(stmt.Rhs) == 1) {
-		return false
-	}
-	iden, ok := stmt.Lhs[0].(*dst.Ident)
-	if !(ok && isType(iden, "net/http", "Client")) {
-		return false
-	}
-	stmt.Decorations().Start.Append(dd_startwrap)
-	stmt.Decorations().End.Append("\n", dd_endwrap)
-	stmt.Rhs[0] = &dst.CallExpr{
-		Fun:  &dst.Ident{Name: "WrapHTTPClient", Path: "github.com/jonbodner/orchestrion/instrument"},
-		Args: []dst.Expr{stmt.Rhs[0]},
-	}
-	return true
-}
-
-func wrapSqlReturnCall(stmt *dst.ReturnStmt) *dst.ReturnStmt {
-	/*
-		//dd:startwrap
-		return sql.Open("postgres", "somepath")
-		//dd:endwrap
-
-		//dd:startwrap
-		return sql.OpenDB(connector)
-		//dd:endwrap
-	*/
-	for _, expr := range stmt.Results {
-		fun, ok := expr.(*dst.CallExpr)
-		if !ok {
-			continue
-		}
-		if wrapSqlCall(fun) {
-			stmt.Decorations().Start.Append(dd_startwrap)
-			stmt.Decorations().Before = dst.NewLine
-			stmt.Decorations().End.Append("\n", dd_endwrap)
-		}
-
-	}
-	return stmt
-}
-
-func wrapSqlOpenFromAssign(stmt *dst.AssignStmt) bool {
-	/*
-		//dd:startwrap
-		db, err = sql.Open("postgres", "somepath")
-		//dd:endwrap
-
-		//dd:startwrap
-		db = sql.OpenDB(connector)
-		//dd:endwrap
-	*/
-
-	rhs := stmt.Rhs[0]
-	fun, ok := rhs.(*dst.CallExpr)
-	if !ok {
-		return false
-	}
-	if wrapSqlCall(fun) {
-		stmt.Decorations().Start.Append(dd_startwrap)
-		stmt.Decorations().End.Append("\n", dd_endwrap)
-		return true
-	}
-	return false
-}
-
-func wrapSqlCall(call *dst.CallExpr) bool {
-	f, ok := call.Fun.(*dst.Ident)
-	if !(ok && f.Path == "database/sql" && (f.Name == "Open" || f.Name == "OpenDB")) {
-		return false
-	}
-	f.Path = "github.com/jonbodner/orchestrion/instrument"
-	return true
-}
-
-func wrapHandlerFromExpr(stmt *dst.ExprStmt) bool {
-	/*
-		//dd:startwrap
-		http.Handle("/handle", orchestrion.WrapHandler(handler))
-		//dd:endwrap
-
-		//dd:startwrap
-		http.HandleFunc("/handle", orchestrion.WrapHandlerFunc(handler))
-		//dd:endwrap
-
-		//dd:startwrap
-		s.Handle("/handle", orchestrion.WrapHandler(handler))
-		//dd:endwrap
-
-		//dd:startwrap
-		s.HandleFunc("/handle", orchestrion.WrapHandlerFunc(handler))
-		//dd:endwrap
-	*/
-	wrap := func(fun *dst.CallExpr, name string) bool {
-		var wrapper string
-		switch name {
-		case "Handle":
-			wrapper = "WrapHandler"
-		case "HandleFunc":
-			wrapper = "WrapHandlerFunc"
-		default:
-			return false
-		}
-		fun.Decorations().Start.Append(dd_startwrap)
-		fun.Decorations().End.Append("\n", dd_endwrap)
-		fun.Args[1] = &dst.CallExpr{
-			Fun:  &dst.Ident{Name: wrapper, Path: "github.com/jonbodner/orchestrion/instrument"},
-			Args: []dst.Expr{fun.Args[1]},
-		}
-		return true
-	}
-	if fun, ok := stmt.X.(*dst.CallExpr); ok && len(fun.Args) == 2 {
-		switch f := fun.Fun.(type) {
-		case *dst.SelectorExpr:
-			if isType(f.X, "net/http", "ServeMux") {
-				return wrap(fun, f.Sel.Name)
-			}
-		case *dst.Ident:
-			if f.Path == "net/http" {
-				return wrap(fun, f.Name)
 			}
 		}
 	}
-	return false
+	return "", nil, false
 }
 
 func isType(node dst.Expr, path string, name string) bool {
@@ -824,7 +902,7 @@ func buildRequestClientCode(requestName string) dst.Stmt {
 		Decs: dst.IfStmtDecorations{
 			NodeDecs: dst.NodeDecs{
 				Before: dst.NewLine,
-				Start:  dst.Decorations{dd_startinstrument},
+				Start:  dst.Decorations{withMode(dd_startinstrument, "report")},
 				After:  dst.NewLine,
 				End:    dst.Decorations{"\n", dd_endinstrument},
 			},
@@ -832,7 +910,16 @@ func buildRequestClientCode(requestName string) dst.Stmt {
 	}
 }
 
-func addInit(decl *dst.FuncDecl) *dst.FuncDecl {
+// initArgs returns the arguments of instrument.Init: the target, and the service if any.
+func initArgs(conf config.Config) []dst.Expr {
+	args := []dst.Expr{&dst.Ident{Name: "orchestrionTarget"}}
+	if conf.Service != "" {
+		args = append(args, &dst.BasicLit{Kind: token.STRING, Value: strconv.Quote(conf.Service)})
+	}
+	return args
+}
+
+func addInit(decl *dst.FuncDecl, conf config.Config) *dst.FuncDecl {
 	//check if magic comment is attached to first line
 	if len(decl.Body.List) > 0 {
 		decs := decl.Body.List[0].Decorations().Start
@@ -849,21 +936,24 @@ func addInit(decl *dst.FuncDecl) *dst.FuncDecl {
 			Call: &dst.CallExpr{
 				Fun: &dst.CallExpr{
 					Fun:  &dst.Ident{Path: "github.com/jonbodner/orchestrion/instrument", Name: "Init"},
-					Args: []dst.Expr{&dst.Ident{Name: "orchestrionTarget"}},
+					Args: initArgs(conf),
 				},
 			},
-			Decs: dst.DeferStmtDecorations{NodeDecs: dst.NodeDecs{
-				Start: dst.Decorations{"\n", dd_startinstrument},
-				End:   dst.Decorations{"\n", dd_endinstrument},
-			}},
 		},
 	}
+	mode := ""
+	if conf.HTTPMode == "wrap" && conf.WrapDefaultClient {
+		newLines = append(newLines, wrapDefaultClient())
+		mode = conf.HTTPMode
+	}
+	newLines[0].Decorations().Start.Append("\n", withMode(dd_startinstrument, mode))
+	newLines[len(newLines)-1].Decorations().End.Append("\n", dd_endinstrument)
 
 	decl.Body.List = append(newLines, decl.Body.List...)
 	return decl
 }
 
-func addCodeToHandler(decl *dst.FuncDecl) *dst.FuncDecl {
+func addCodeToHandler(decl *dst.FuncDecl, name string, conf config.Config) *dst.FuncDecl {
 	//check if magic comment is attached to first line
 	if len(decl.Body.List) > 0 {
 		decs := decl.Body.List[0].Decorations().Start
@@ -881,13 +971,14 @@ func addCodeToHandler(decl *dst.FuncDecl) *dst.FuncDecl {
 		requestName = names[0].Name
 	}
 	newLines := buildFunctionInstrumentation(
-		&dst.BasicLit{Kind: token.STRING, Value: `"` + decl.Name.Name + `"`},
-		requestName)
+		&dst.BasicLit{Kind: token.STRING, Value: `"` + name + `"`},
+		requestName,
+		conf)
 	decl.Body.List = append(newLines, decl.Body.List...)
 	return decl
 }
 
-func buildFunctionInstrumentation(funcName dst.Expr, requestName string) []dst.Stmt {
+func buildFunctionInstrumentation(funcName dst.Expr, requestName string, conf config.Config) []dst.Stmt {
 	/*
 		lines to insert:
 			//dd:startinstrument
@@ -931,12 +1022,12 @@ func buildFunctionInstrumentation(funcName dst.Expr, requestName string) []dst.S
 			},
 			Decs: dst.AssignStmtDecorations{NodeDecs: dst.NodeDecs{
 				Before: dst.NewLine,
-				Start:  dst.Decorations{dd_startinstrument},
+				Start:  dst.Decorations{withMode(dd_startinstrument, conf.HTTPMode)},
 				After:  dst.NewLine,
 			}},
 		},
 		&dst.DeferStmt{
-			Call: &dst.CallExpr{
+			Call: deferredEnd(&dst.CallExpr{
 				Fun: &dst.Ident{Name: "Report", Path: "github.com/jonbodner/orchestrion/instrument"},
 				Args: []dst.Expr{
 					&dst.CallExpr{Fun: &dst.SelectorExpr{
@@ -952,7 +1043,7 @@ func buildFunctionInstrumentation(funcName dst.Expr, requestName string) []dst.S
 						Sel: &dst.Ident{Name: "Method"},
 					},
 				},
-			},
+			}, false, conf),
 			Decs: dst.DeferStmtDecorations{NodeDecs: dst.NodeDecs{
 				After: dst.NewLine,
 				End:   dst.Decorations{"\n", dd_endinstrument},
@@ -992,7 +1083,7 @@ func reportHandlerFromAssign(stmt *dst.AssignStmt, tc *typechecker.TypeChecker,
 					if funLit, ok := kv.Value.(*dst.FuncLit); ok {
 						if analyzeExpressionForHandlerLiteral(funLit, tc) {
 							// get the name from the field
-							funLit.Body.List = buildFunctionLiteralHandlerCode(kv.Key, funLit)
+							funLit.Body.List = buildFunctionLiteralHandlerCode(kv.Key, funLit, conf)
 						}
 					}
 				}
@@ -1004,7 +1095,7 @@ func reportHandlerFromAssign(stmt *dst.AssignStmt, tc *typechecker.TypeChecker,
 				if len(stmt.Lhs) <= pos {
 					break
 				}
-				funLit.Body.List = buildFunctionLiteralHandlerCode(stmt.Lhs[pos], funLit)
+				funLit.Body.List = buildFunctionLiteralHandlerCode(stmt.Lhs[pos], funLit, conf)
 			}
 		}
 	}
@@ -1017,7 +1108,7 @@ func reportHandlerFromExpr(stmt *dst.ExprStmt, tc *typechecker.TypeChecker, conf
 		switch funLit := call.Fun.(type) {
 		case *dst.FuncLit:
 			if analyzeExpressionForHandlerLiteral(funLit, tc) {
-				funLit.Body.List = buildFunctionLiteralHandlerCode(nil, funLit)
+				funLit.Body.List = buildFunctionLiteralHandlerCode(nil, funLit, conf)
 			}
 		}
 		// check if any of the parameters is a function literal
@@ -1026,7 +1117,7 @@ func reportHandlerFromExpr(stmt *dst.ExprStmt, tc *typechecker.TypeChecker, conf
 			if funLit, ok := v.(*dst.FuncLit); ok {
 				// check for function literal that is a handler
 				if analyzeExpressionForHandlerLiteral(funLit, tc) {
-					funLit.Body.List = buildFunctionLiteralHandlerCode(prevExpr, funLit)
+					funLit.Body.List = buildFunctionLiteralHandlerCode(prevExpr, funLit, conf)
 				}
 			}
 			prevExpr = v
@@ -1040,10 +1131,59 @@ func reportHandlerFromDecl(decl *dst.FuncDecl, tc *typechecker.TypeChecker, conf
 	}
 	// check the parameters, see if they match
 	inputParams := decl.Type.Params.List
-	if len(inputParams) == 2 &&
+	if !(len(inputParams) == 2 &&
 		tc.OfType(inputParams[0].Type, "net/http.ResponseWriter") &&
-		tc.OfType(inputParams[1].Type, "*net/http.Request") {
-		decl = addCodeToHandler(decl)
+		tc.OfType(inputParams[1].Type, "*net/http.Request")) {
+		return decl
 	}
-	return decl
+	name := decl.Name.Name
+	// ServeHTTP methods of http.Handler implementations are named after their type
+	if name == "ServeHTTP" && decl.Recv != nil && len(decl.Recv.List) == 1 {
+		recv := decl.Recv.List[0].Type
+		if tc.Implements(recv, "net/http.Handler") {
+			name = receiverName(recv) + "." + name
+			if isWrappedHandler(recv, tc) {
+				log.Printf("%s is wrapped when registered, skipping", name)
+				return decl
+			}
+		}
+	}
+	return addCodeToHandler(decl, name, conf)
+}
+
+// handlerWrappers are the functions tracing the http.Handler passed as first argument.
+var handlerWrappers = []string{
+	rules.RuntimePackage + ".WrapHandler",
+	"gopkg.in/DataDog/dd-trace-go.v1/contrib/net/http.WrapHandler",
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp.NewHandler",
+}
+
+// isWrappedHandler reports whether a handler of type recv, or a pointer to it, is
+// traced when it is registered somewhere in its package or in the other packages loaded.
+func isWrappedHandler(recv dst.Expr, tc *typechecker.TypeChecker) bool {
+	typ := strings.TrimPrefix(tc.TypeOf(recv), "*")
+	if typ == "" {
+		return false
+	}
+	for _, t := range tc.ArgTypes(0, handlerWrappers...) {
+		if strings.TrimPrefix(t, "*") == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// receiverName returns the name of the receiver type recv, e.g. *UserAPI.
+func receiverName(recv dst.Expr) string {
+	switch recv := recv.(type) {
+	case *dst.StarExpr:
+		return "*" + receiverName(recv.X)
+	case *dst.IndexExpr:
+		return receiverName(recv.X)
+	case *dst.IndexListExpr:
+		return receiverName(recv.X)
+	case *dst.Ident:
+		return recv.Name
+	}
+	return ""
 }
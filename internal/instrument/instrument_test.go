@@ -9,10 +9,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
 	"github.com/jonbodner/orchestrion/internal/config"
+	"github.com/jonbodner/orchestrion/internal/rules"
+	"github.com/jonbodner/orchestrion/internal/typechecker"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -79,7 +83,7 @@ var s *http.Server
 func register() {
 	s = &http.Server{
 		Addr: ":8080",
-		//dd:startwrap
+		//dd:startwrap v2 mode=wrap
 		Handler: %s,
 		//dd:endwrap
 	}
@@ -94,11 +98,11 @@ func register() {
 		{
 			in: codeTpl(`http.Handle("/handle", handler)
 	http.Handle("/other", handler2)`),
-			want: wantTpl(`//dd:startwrap
-	http.Handle("/handle", instrument.WrapHandler(handler))
+			want: wantTpl(`//dd:startwrap v2 mode=wrap
+	http.Handle("/handle", instrument.WrapHandler(handler, "/handle"))
 	//dd:endwrap
-	//dd:startwrap
-	http.Handle("/other", instrument.WrapHandler(handler2))
+	//dd:startwrap v2 mode=wrap
+	http.Handle("/other", instrument.WrapHandler(handler2, "/other"))
 	//dd:endwrap`),
 		},
 		{in: codeTpl2(`http.HandlerFunc(myHandler)`), want: wantTpl2(`instrument.WrapHandler(http.HandlerFunc(myHandler))`)},
@@ -159,11 +163,11 @@ func register() {
 		{
 			in: `http.Handle("/handle", handler)
 	http.Handle("/other", handler2)`,
-			want: `//dd:startwrap
-	http.Handle("/handle", instrument.WrapHandler(handler))
+			want: `//dd:startwrap v2 mode=wrap
+	http.Handle("/handle", instrument.WrapHandler(handler, "/handle"))
 	//dd:endwrap
-	//dd:startwrap
-	http.Handle("/other", instrument.WrapHandler(handler2))
+	//dd:startwrap v2 mode=wrap
+	http.Handle("/other", instrument.WrapHandler(handler2, "/other"))
 	//dd:endwrap`,
 		},
 	}
@@ -210,7 +214,7 @@ import (
 var s http.ServeMux
 
 func register() {
-	//dd:startwrap
+	//dd:startwrap v2 mode=wrap
 	%s
 	//dd:endwrap
 }
@@ -219,18 +223,21 @@ func register() {
 		in   string
 		want string
 	}{
-		{in: `http.Handle("/handle", handler)`, want: `http.Handle("/handle", instrument.WrapHandler(handler))`},
-		{in: `http.Handle("/handle", http.HandlerFunc(myHandler))`, want: `http.Handle("/handle", instrument.WrapHandler(http.HandlerFunc(myHandler)))`},
-		{in: `http.Handle("/handle", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))`, want: `http.Handle("/handle", instrument.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))`},
-		{in: `http.HandleFunc("/handle", handler)`, want: `http.HandleFunc("/handle", instrument.WrapHandlerFunc(handler))`},
-		{in: `http.HandleFunc("/handle", http.HandlerFunc(myHandler))`, want: `http.HandleFunc("/handle", instrument.WrapHandlerFunc(http.HandlerFunc(myHandler)))`},
-		{in: `http.HandleFunc("/handle", func(w http.ResponseWriter, r *http.Request) {})`, want: `http.HandleFunc("/handle", instrument.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))`},
-		{in: `s.Handle("/handle", handler)`, want: `s.Handle("/handle", instrument.WrapHandler(handler))`},
-		{in: `s.Handle("/handle", http.HandlerFunc(myHandler))`, want: `s.Handle("/handle", instrument.WrapHandler(http.HandlerFunc(myHandler)))`},
-		{in: `s.Handle("/handle", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))`, want: `s.Handle("/handle", instrument.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))`},
-		{in: `s.HandleFunc("/handle", handler)`, want: `s.HandleFunc("/handle", instrument.WrapHandlerFunc(handler))`},
-		{in: `s.HandleFunc("/handle", http.HandlerFunc(myHandler))`, want: `s.HandleFunc("/handle", instrument.WrapHandlerFunc(http.HandlerFunc(myHandler)))`},
-		{in: `s.HandleFunc("/handle", func(w http.ResponseWriter, r *http.Request) {})`, want: `s.HandleFunc("/handle", instrument.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))`},
+		{in: `http.Handle("/handle", handler)`, want: `http.Handle("/handle", instrument.WrapHandler(handler, "/handle"))`},
+		{in: `http.Handle("/handle", http.HandlerFunc(myHandler))`, want: `http.Handle("/handle", instrument.WrapHandler(http.HandlerFunc(myHandler), "/handle"))`},
+		{in: `http.Handle("/handle", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))`, want: `http.Handle("/handle", instrument.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "/handle"))`},
+		{in: `http.HandleFunc("/handle", handler)`, want: `http.HandleFunc("/handle", instrument.WrapHandlerFunc(handler, "/handle"))`},
+		{in: `http.HandleFunc("/handle", http.HandlerFunc(myHandler))`, want: `http.HandleFunc("/handle", instrument.WrapHandlerFunc(http.HandlerFunc(myHandler), "/handle"))`},
+		{in: `http.HandleFunc("/handle", func(w http.ResponseWriter, r *http.Request) {})`, want: `http.HandleFunc("/handle", instrument.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {}, "/handle"))`},
+		{in: `s.Handle("/handle", handler)`, want: `s.Handle("/handle", instrument.WrapHandler(handler, "/handle"))`},
+		{in: `s.Handle("/handle", http.HandlerFunc(myHandler))`, want: `s.Handle("/handle", instrument.WrapHandler(http.HandlerFunc(myHandler), "/handle"))`},
+		{in: `s.Handle("/handle", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))`, want: `s.Handle("/handle", instrument.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "/handle"))`},
+		{in: `s.HandleFunc("/handle", handler)`, want: `s.HandleFunc("/handle", instrument.WrapHandlerFunc(handler, "/handle"))`},
+		{in: `s.HandleFunc("/handle", http.HandlerFunc(myHandler))`, want: `s.HandleFunc("/handle", instrument.WrapHandlerFunc(http.HandlerFunc(myHandler), "/handle"))`},
+		{in: `s.HandleFunc("/handle", func(w http.ResponseWriter, r *http.Request) {})`, want: `s.HandleFunc("/handle", instrument.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {}, "/handle"))`},
+		{in: `s.HandleFunc("GET /users/{id}", handler)`, want: `s.HandleFunc("GET /users/{id}", instrument.WrapHandlerFunc(handler, "GET /users/{id}"))`},
+		{in: `s.Handle(prefix+"/users", handler)`, want: `s.Handle(prefix+"/users", instrument.WrapHandler(handler, prefix+"/users"))`},
+		{in: `s.Handle(route(), handler)`, want: `s.Handle(route(), instrument.WrapHandler(handler))`},
 	}
 
 	for _, tc := range tests {
@@ -274,7 +281,7 @@ import (
 var s *http.ServeMux
 
 func register() {
-	//dd:startwrap
+	//dd:startwrap v2 mode=wrap
 	%s
 	//dd:endwrap
 }
@@ -283,12 +290,12 @@ func register() {
 		in   string
 		want string
 	}{
-		{in: `s.Handle("/handle", handler)`, want: `s.Handle("/handle", instrument.WrapHandler(handler))`},
-		{in: `s.Handle("/handle", http.HandlerFunc(myHandler))`, want: `s.Handle("/handle", instrument.WrapHandler(http.HandlerFunc(myHandler)))`},
-		{in: `s.Handle("/handle", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))`, want: `s.Handle("/handle", instrument.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))`},
-		{in: `s.HandleFunc("/handle", handler)`, want: `s.HandleFunc("/handle", instrument.WrapHandlerFunc(handler))`},
-		{in: `s.HandleFunc("/handle", http.HandlerFunc(myHandler))`, want: `s.HandleFunc("/handle", instrument.WrapHandlerFunc(http.HandlerFunc(myHandler)))`},
-		{in: `s.HandleFunc("/handle", func(w http.ResponseWriter, r *http.Request) {})`, want: `s.HandleFunc("/handle", instrument.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))`},
+		{in: `s.Handle("/handle", handler)`, want: `s.Handle("/handle", instrument.WrapHandler(handler, "/handle"))`},
+		{in: `s.Handle("/handle", http.HandlerFunc(myHandler))`, want: `s.Handle("/handle", instrument.WrapHandler(http.HandlerFunc(myHandler), "/handle"))`},
+		{in: `s.Handle("/handle", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))`, want: `s.Handle("/handle", instrument.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "/handle"))`},
+		{in: `s.HandleFunc("/handle", handler)`, want: `s.HandleFunc("/handle", instrument.WrapHandlerFunc(handler, "/handle"))`},
+		{in: `s.HandleFunc("/handle", http.HandlerFunc(myHandler))`, want: `s.HandleFunc("/handle", instrument.WrapHandlerFunc(http.HandlerFunc(myHandler), "/handle"))`},
+		{in: `s.HandleFunc("/handle", func(w http.ResponseWriter, r *http.Request) {})`, want: `s.HandleFunc("/handle", instrument.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {}, "/handle"))`},
 	}
 
 	for _, tc := range tests {
@@ -337,7 +344,7 @@ var s *http.Server
 func register() {
 	s = &http.Server{
 		Addr: ":8080",
-		//dd:startwrap
+		//dd:startwrap v2 mode=wrap
 		Handler: %s,
 		//dd:endwrap
 	}
@@ -363,17 +370,83 @@ func register() {
 			want := fmt.Sprintf(wantTpl, tc.want)
 			require.Equal(t, want, string(got))
 
-			// TODO: Implement unwrapHandlerAssign to uncomment the following assertions!
-			//
-			// reader, err = UninstrumentFile("test", strings.NewReader(want))
-			// require.Nil(t, err)
-			// orig, err := io.ReadAll(reader)
-			// require.Nil(t, err)
-			// require.Equal(t, code, string(orig))
+			reader, err = UninstrumentFile("test", strings.NewReader(want), config.Default)
+			require.Nil(t, err)
+			orig, err := io.ReadAll(reader)
+			require.Nil(t, err)
+			require.Equal(t, code, string(orig))
 		})
 	}
 }
 
+func TestWrapHandlerField(t *testing.T) {
+	// only the Handler of http.Server is wrapped
+	code := `package main
+
+import "net/http"
+
+type server struct {
+	Handler http.Handler
+}
+
+func register() *server {
+	return &server{Handler: myHandler}
+}
+`
+	reader, err := InstrumentFile("test", strings.NewReader(code), config.Default)
+	require.Nil(t, err)
+	got, err := io.ReadAll(reader)
+	require.Nil(t, err)
+	require.Equal(t, code, string(got))
+}
+
+func TestUnwrapMethodReceiver(t *testing.T) {
+	// the method Handle of router takes an instrumented handler: it is not wrapped by orchestrion
+	code := `package main
+
+import (
+	"net/http"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+type router struct{}
+
+func (router) Handle(pattern string, h http.Handler) {}
+
+func register(s *http.ServeMux, r router) {
+	//dd:startwrap v2 mode=wrap
+	s.Handle("/handle", instrument.WrapHandler(handler, "/handle"))
+	//dd:endwrap
+	//dd:startwrap v2 mode=wrap
+	r.Handle("/other", instrument.WrapHandler(handler, "/other"))
+	//dd:endwrap
+}
+`
+	want := `package main
+
+import (
+	"net/http"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+type router struct{}
+
+func (router) Handle(pattern string, h http.Handler) {}
+
+func register(s *http.ServeMux, r router) {
+	s.Handle("/handle", handler)
+	r.Handle("/other", instrument.WrapHandler(handler, "/other"))
+}
+`
+	reader, err := UninstrumentFile("test", strings.NewReader(code), config.Default)
+	require.Nil(t, err)
+	got, err := io.ReadAll(reader)
+	require.Nil(t, err)
+	require.Equal(t, want, string(got))
+}
+
 func TestWrapClientAssign(t *testing.T) {
 	var codeTpl = `package main
 
@@ -396,7 +469,7 @@ import (
 var c *http.Client
 
 func init() {
-	//dd:startwrap
+	//dd:startwrap v2 mode=wrap
 	c = %s
 	//dd:endwrap
 }
@@ -453,7 +526,7 @@ import (
 
 //dd:span foo:bar other:tag
 func MyFunc(somectx context.Context) {
-	//dd:startinstrument
+	//dd:startinstrument v2
 	somectx = instrument.Report(somectx, instrument.EventStart, "function-name", "MyFunc", "foo", "bar", "other", "tag")
 	defer instrument.Report(somectx, instrument.EventEnd, "function-name", "MyFunc", "foo", "bar", "other", "tag")
 	//dd:endinstrument%s
@@ -498,13 +571,13 @@ func main() {
 import "github.com/jonbodner/orchestrion/instrument"
 
 func main() {
-	//dd:startinstrument
+	//dd:startinstrument v2
 	defer instrument.Init(orchestrionTarget)()
 	//dd:endinstrument
 	whatever.code
 }
 
-//dd:startinstrument
+//dd:startinstrument v2 target=console
 var orchestrionTarget = "console"
 
 //dd:endinstrument
@@ -548,6 +621,49 @@ func TestHTTPModeConfig(t *testing.T) {
 	}
 }
 
+func TestConvertHTTPMode(t *testing.T) {
+	for _, tc := range []struct {
+		in, out, mode string
+	}{
+		{in: "./testdata/http_wrapped.go", out: "./testdata/http_reported.go", mode: "report"},
+		{in: "./testdata/http_reported.go", out: "./testdata/http_wrapped.go", mode: "wrap"},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			in, err := os.Open(tc.in)
+			require.NoError(t, err)
+
+			reader, err := InstrumentFile(in.Name(), in, config.Config{HTTPMode: tc.mode, Instrumentation: "console"})
+			require.NoError(t, err)
+
+			got, err := io.ReadAll(reader)
+			require.NoError(t, err)
+
+			want, err := os.ReadFile(tc.out)
+			require.NoError(t, err)
+
+			require.Equal(t, string(want), string(got))
+		})
+	}
+
+	t.Run("target", func(t *testing.T) {
+		in, err := os.Open("./testdata/http_wrapped.go")
+		require.NoError(t, err)
+
+		reader, err := InstrumentFile(in.Name(), in, config.Config{HTTPMode: "wrap", Instrumentation: "dd"})
+		require.NoError(t, err)
+
+		got, err := io.ReadAll(reader)
+		require.NoError(t, err)
+
+		want, err := os.ReadFile("./testdata/http_wrapped.go")
+		require.NoError(t, err)
+
+		require.Equal(t, strings.Replace(string(want), `target=console
+var orchestrionTarget = "console"`, `target=dd
+var orchestrionTarget = "dd"`, 1), string(got))
+	})
+}
+
 func TestWrapSqlExpr(t *testing.T) {
 	var codeTpl = `package main
 
@@ -562,7 +678,7 @@ func register() {
 import "github.com/jonbodner/orchestrion/instrument"
 
 func register() {
-	//dd:startwrap
+	//dd:startwrap v2
 	%s
 	//dd:endwrap
 }
@@ -596,7 +712,7 @@ func register() {
 		return sql.Open("db", "mypath")
 	}()`,
 			want: `func() (*sql.DB, error) {
-		//dd:startwrap
+		//dd:startwrap v2
 		return instrument.Open("db", "mypath")
 		//dd:endwrap
 	}()`,
@@ -608,7 +724,7 @@ func register() {
 		return sql.Open("db", "mypath")
 	}`,
 			want: `f := func() (*sql.DB, error) {
-		//dd:startwrap
+		//dd:startwrap v2
 		return instrument.Open("db", "mypath")
 		//dd:endwrap
 	}`,
@@ -656,7 +772,7 @@ import (
 var s *grpc.Server
 
 func init() {
-	//dd:startwrap
+	//dd:startwrap v2
 	s = %s
 	//dd:endwrap
 }
@@ -711,7 +827,7 @@ var c *grpc.ClientConn
 
 func init() {
 	var err error
-	//dd:startwrap
+	//dd:startwrap v2
 	c, err = %s
 	//dd:endwrap
 }
@@ -887,3 +1003,1297 @@ func init() {
 
 	})
 }
+
+func TestCustomRules(t *testing.T) {
+	conf := config.Config{
+		HTTPMode:        "wrap",
+		Instrumentation: "console",
+		Rules: []rules.Rule{
+			{
+				Name:   "redis",
+				Match:  rules.Match{Package: "github.com/acme/redis", Function: "NewClient"},
+				Action: rules.Action{Kind: rules.WrapArgument, Package: "github.com/acme/tracing", Function: "WrapOptions"},
+			},
+			{
+				Name:  "sql-query",
+				Match: rules.Match{Package: "database/sql", Type: "DB", Function: "QueryContext"},
+				Action: rules.Action{
+					Kind:       rules.PrependStatements,
+					Statements: []string{`log.Printf("query")`, `instrument.Report(ctx, instrument.EventDBCall)`},
+					Imports:    map[string]string{"log": "log"},
+				},
+			},
+		},
+	}
+	require.NoError(t, conf.Validate())
+
+	var code = `package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/acme/redis"
+)
+
+func get(ctx context.Context, db *sql.DB) (*sql.Rows, error) {
+	rdb := redis.NewClient(&redis.Options{})
+	return db.QueryContext(ctx, "SELECT 1")
+}
+`
+	var want = `package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/acme/redis"
+	"github.com/acme/tracing"
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+func get(ctx context.Context, db *sql.DB) (*sql.Rows, error) {
+	//dd:startwrap v2
+	rdb := redis.NewClient(tracing.WrapOptions(&redis.Options{}))
+	//dd:endwrap
+	//dd:startinstrument v2
+	log.Printf("query")
+	instrument.Report(ctx, instrument.EventDBCall)
+	//dd:endinstrument
+	//dd:instrumented
+	return db.QueryContext(ctx, "SELECT 1")
+}
+`
+	reader, err := InstrumentFile("test", strings.NewReader(code), conf)
+	require.NoError(t, err)
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, want, string(got))
+
+	reader, err = UninstrumentFile("test", strings.NewReader(want), conf)
+	require.NoError(t, err)
+	orig, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, code, string(orig))
+}
+
+func TestLineDirectives(t *testing.T) {
+	var code = `package main
+
+import "context"
+
+//dd:span foo:bar
+func MyFunc(ctx context.Context) {
+	x := 1
+	switch x {
+	case 1:
+		panic("boom")
+	}
+}
+`
+	var want = `//line test.go:1
+package main
+
+/*line test.go:3*/import (
+	"context"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+//dd:span foo:bar
+/*line test.go:6*/func MyFunc(ctx context.Context) {
+	//dd:startinstrument v2
+	/*line test.go:6*/ctx = instrument.Report(ctx, instrument.EventStart, "function-name", "MyFunc", "foo", "bar")
+	/*line test.go:6*/defer instrument.Report(ctx, instrument.EventEnd, "function-name", "MyFunc", "foo", "bar")
+	//dd:endinstrument
+	/*line test.go:7*/x := 1
+	/*line test.go:8*/switch x {
+	/*line test.go:9*/case 1:
+		/*line test.go:10*/panic("boom")
+	}
+}
+`
+	conf := config.Default
+	conf.LineDirectives = true
+	reader, err := InstrumentFile("test.go", strings.NewReader(code), conf)
+	require.NoError(t, err)
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, want, string(got))
+}
+
+func TestLineDirectivesInsertedBlocks(t *testing.T) {
+	// the inserted code is reported at the line of its declaration,
+	// and the line of the braces following it is restored
+	var code = `package main
+
+import (
+	"context"
+	"net/http"
+)
+
+func get(ctx context.Context, u string) {
+	switch {
+	default:
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+	}
+}
+
+func main() {
+	get(context.Background(), "")
+}
+`
+	var want = `//line test.go:1
+package main
+
+/*line test.go:3*/import (
+	"context"
+	"net/http"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+/*line test.go:8*/func get(ctx context.Context, u string) {
+	/*line test.go:9*/switch {
+	/*line test.go:10*/default:
+		//dd:instrumented
+		//dd:startwrap v2 mode=report
+		/*line test.go:11*/req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		//dd:endwrap
+		//dd:startinstrument v2 mode=report
+		/*line test.go:8*/if req != nil {
+			/*line test.go:8*/req = req.WithContext(instrument.Report(req.Context(), instrument.EventCall, "name", req.URL, "verb", req.Method))
+			/*line test.go:8*/req = instrument.InsertHeader(req)
+			/*line test.go:8*/defer instrument.Report(req.Context(), instrument.EventReturn, "name", req.URL, "verb", req.Method)
+		}
+		//dd:endinstrument
+	/*line test.go:12*/}
+}
+
+/*line test.go:15*/func main() {
+	//dd:startinstrument v2
+	/*line test.go:15*/defer instrument.Init(orchestrionTarget)()
+	//dd:endinstrument
+	/*line test.go:16*/get(context.Background(), "")
+}
+
+//dd:startinstrument v2 target=console
+/*line test.go:1*/var orchestrionTarget = "console"
+
+//dd:endinstrument
+`
+	conf := config.Config{HTTPMode: "report", Instrumentation: "console", LineDirectives: true}
+	reader, err := InstrumentFile("test.go", strings.NewReader(code), conf)
+	require.NoError(t, err)
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, want, string(got))
+}
+
+func TestSpanErrorResult(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		results   string
+		want      string
+		errorName string
+	}{
+		{name: "unnamed", results: "error", want: "(orchestrionErr error)", errorName: "orchestrionErr"},
+		{name: "unnamed many", results: "(int, error)", want: "(_ int, orchestrionErr error)", errorName: "orchestrionErr"},
+		{name: "named", results: "(n int, err error)", want: "(n int, err error)", errorName: "err"},
+		{name: "blank", results: "(n int, _ error)", want: "(n int, orchestrionErr error)", errorName: "orchestrionErr"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var code = fmt.Sprintf(`package main
+
+import "context"
+
+//dd:span foo:bar
+func MyFunc(ctx context.Context) %s {
+	panic("unimplemented")
+}
+`, tt.results)
+			var want = fmt.Sprintf(`package main
+
+import (
+	"context"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+//dd:span foo:bar
+func MyFunc(ctx context.Context) %s {
+	//dd:startinstrument v2
+	ctx = instrument.Report(ctx, instrument.EventStart, "function-name", "MyFunc", "foo", "bar")
+	defer func() {
+		instrument.Report(ctx, instrument.EventEnd, "function-name", "MyFunc", "foo", "bar", "error", %s)
+	}()
+	//dd:endinstrument
+	panic("unimplemented")
+}
+`, tt.want, tt.errorName)
+			reader, err := InstrumentFile("test", strings.NewReader(code), config.Default)
+			require.NoError(t, err)
+			got, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, want, string(got))
+
+			reader, err = UninstrumentFile("test", strings.NewReader(want), config.Default)
+			require.NoError(t, err)
+			orig, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, code, string(orig))
+		})
+	}
+}
+
+func TestRecordPanics(t *testing.T) {
+	var code = `package main
+
+import (
+	"context"
+	"net/http"
+)
+
+//dd:span foo:bar
+func MyFunc(ctx context.Context) error {
+	return nil
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+`
+	var want = `package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+//dd:span foo:bar
+func MyFunc(ctx context.Context) (orchestrionErr error) {
+	//dd:startinstrument v2
+	ctx = instrument.Report(ctx, instrument.EventStart, "function-name", "MyFunc", "foo", "bar")
+	defer func() {
+		instrument.ReportPanic(ctx, recover(), instrument.EventEnd, "function-name", "MyFunc", "foo", "bar", "error", orchestrionErr)
+	}()
+	//dd:endinstrument
+	return nil
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	//dd:startinstrument v2 mode=report
+	r = r.WithContext(instrument.Report(r.Context(), instrument.EventStart, "name", "handler", "verb", r.Method))
+	defer func() {
+		instrument.ReportPanic(r.Context(), recover(), instrument.EventEnd, "name", "handler", "verb", r.Method)
+	}()
+	//dd:endinstrument
+	w.WriteHeader(http.StatusOK)
+}
+`
+	conf := config.Config{HTTPMode: "report", Instrumentation: "console", RecordPanics: true}
+	reader, err := InstrumentFile("test", strings.NewReader(code), conf)
+	require.NoError(t, err)
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, want, string(got))
+
+	reader, err = UninstrumentFile("test", strings.NewReader(want), conf)
+	require.NoError(t, err)
+	orig, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, code, string(orig))
+}
+
+func TestSpanParameterTags(t *testing.T) {
+	var code = `package main
+
+import "context"
+
+type Order struct {
+	ID   int
+	User struct{ Name string }
+}
+
+//dd:span order:$order.ID user:$order.User.Name other:$o missing:$order.Missing kind:static
+func MyFunc(ctx context.Context, order *Order) {
+	panic("unimplemented")
+}
+`
+	var want = `package main
+
+import (
+	"context"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+type Order struct {
+	ID   int
+	User struct{ Name string }
+}
+
+//dd:span order:$order.ID user:$order.User.Name other:$o missing:$order.Missing kind:static
+func MyFunc(ctx context.Context, order *Order) {
+	//dd:startinstrument v2
+	ctx = instrument.Report(ctx, instrument.EventStart, "function-name", "MyFunc", "order", order.ID, "user", order.User.Name, "kind", "static")
+	defer instrument.Report(ctx, instrument.EventEnd, "function-name", "MyFunc", "order", order.ID, "user", order.User.Name, "kind", "static")
+	//dd:endinstrument
+	panic("unimplemented")
+}
+`
+	reader, err := InstrumentFile("test", strings.NewReader(code), config.Default)
+	require.NoError(t, err)
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, want, string(got))
+
+	reader, err = UninstrumentFile("test", strings.NewReader(want), config.Default)
+	require.NoError(t, err)
+	orig, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, code, string(orig))
+}
+
+func TestSpanContextAccessors(t *testing.T) {
+	conf := config.Default
+	conf.Contexts = []rules.Context{{Type: "*example.com/web.Context", Get: "$param.Ctx()", Set: "$param.SetCtx($ctx)"}}
+	for _, tt := range []struct {
+		name string
+		code string
+		want string
+	}{
+		{
+			name: "request",
+			code: `package main
+
+import "net/http"
+
+//dd:span foo:bar
+func MyFunc(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+`,
+			want: `package main
+
+import (
+	"net/http"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+//dd:span foo:bar
+func MyFunc(w http.ResponseWriter, r *http.Request) (orchestrionErr error) {
+	//dd:startinstrument v2
+	r = r.WithContext(instrument.Report(r.Context(), instrument.EventStart, "function-name", "MyFunc", "foo", "bar"))
+	defer func() {
+		instrument.Report(r.Context(), instrument.EventEnd, "function-name", "MyFunc", "foo", "bar", "error", orchestrionErr)
+	}()
+	//dd:endinstrument
+	return nil
+}
+`,
+		},
+		{
+			name: "gin",
+			code: `package main
+
+import "github.com/gin-gonic/gin"
+
+//dd:span foo:bar
+func MyFunc(c *gin.Context) {
+	c.Status(200)
+}
+`,
+			want: `package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+//dd:span foo:bar
+func MyFunc(c *gin.Context) {
+	//dd:startinstrument v2
+	c.Request = c.Request.WithContext(instrument.Report(c.Request.Context(), instrument.EventStart, "function-name", "MyFunc", "foo", "bar"))
+	defer instrument.Report(c.Request.Context(), instrument.EventEnd, "function-name", "MyFunc", "foo", "bar")
+	//dd:endinstrument
+	c.Status(200)
+}
+`,
+		},
+		{
+			name: "custom",
+			code: `package main
+
+import "example.com/web"
+
+//dd:span foo:bar
+func MyFunc(c *web.Context) {
+	c.Reply()
+}
+`,
+			want: `package main
+
+import (
+	"example.com/web"
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+//dd:span foo:bar
+func MyFunc(c *web.Context) {
+	//dd:startinstrument v2
+	c.SetCtx(instrument.Report(c.Ctx(), instrument.EventStart, "function-name", "MyFunc", "foo", "bar"))
+	defer instrument.Report(c.Ctx(), instrument.EventEnd, "function-name", "MyFunc", "foo", "bar")
+	//dd:endinstrument
+	c.Reply()
+}
+`,
+		},
+		{
+			name: "root span",
+			code: `package main
+
+//dd:span foo:bar
+func MyFunc(name string) {
+	println(name)
+}
+`,
+			want: `package main
+
+import (
+	"context"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+//dd:span foo:bar
+func MyFunc(name string) {
+	//dd:startinstrument v2
+	orchestrionCtx := instrument.Report(context.Background(), instrument.EventStart, "function-name", "MyFunc", "foo", "bar")
+	defer instrument.Report(orchestrionCtx, instrument.EventEnd, "function-name", "MyFunc", "foo", "bar")
+	//dd:endinstrument
+	println(name)
+}
+`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := InstrumentFile("test", strings.NewReader(tt.code), conf)
+			require.NoError(t, err)
+			got, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, string(got))
+
+			reader, err = UninstrumentFile("test", strings.NewReader(tt.want), conf)
+			require.NoError(t, err)
+			orig, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, tt.code, string(orig))
+		})
+	}
+}
+
+func TestWrapRouters(t *testing.T) {
+	var codeTpl = `package main
+
+import %q
+
+func register() {
+	r := %s
+	_ = r
+}
+`
+	var wantTpl = `package main
+
+import (
+	%q
+	%q
+)
+
+func register() {
+	//dd:startwrap v2 mode=wrap
+	r := %s
+	//dd:endwrap
+	_ = r
+}
+`
+	for _, tt := range []struct {
+		path string
+		in   string
+		wrap string
+		want string
+	}{
+		{path: "github.com/go-chi/chi/v5", in: `chi.NewRouter()`, wrap: "chitrace", want: `chitrace.WrapRouter(chi.NewRouter())`},
+		{path: "github.com/go-chi/chi/v5", in: `chi.NewMux()`, wrap: "chitrace", want: `chitrace.WrapRouter(chi.NewMux())`},
+		{path: "github.com/labstack/echo/v4", in: `echo.New()`, wrap: "echotrace", want: `echotrace.WrapRouter(echo.New())`},
+		{path: "github.com/gin-gonic/gin", in: `gin.New()`, wrap: "gintrace", want: `gintrace.WrapRouter(gin.New())`},
+		{path: "github.com/gin-gonic/gin", in: `gin.Default()`, wrap: "gintrace", want: `gintrace.WrapRouter(gin.Default())`},
+		{path: "github.com/gorilla/mux", in: `mux.NewRouter()`, wrap: "muxtrace", want: `muxtrace.WrapRouter(mux.NewRouter())`},
+	} {
+		t.Run(tt.in, func(t *testing.T) {
+			code := fmt.Sprintf(codeTpl, tt.path, tt.in)
+			reader, err := InstrumentFile("test", strings.NewReader(code), config.Default)
+			require.NoError(t, err)
+			got, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			imports := []string{tt.path, rules.RuntimePackage + "/" + tt.wrap}
+			sort.Strings(imports)
+			want := fmt.Sprintf(wantTpl, imports[0], imports[1], tt.want)
+			require.Equal(t, want, string(got))
+
+			// the routers already wrapped are left alone
+			reader, err = InstrumentFile("test", strings.NewReader(want), config.Default)
+			require.NoError(t, err)
+			got, err = io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, want, string(got))
+
+			reader, err = UninstrumentFile("test", strings.NewReader(want), config.Default)
+			require.NoError(t, err)
+			orig, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, code, string(orig))
+		})
+	}
+}
+
+func TestPackageNames(t *testing.T) {
+	for path, want := range map[string]string{
+		"fmt":                              "fmt",
+		"net/http":                         "http",
+		"github.com/go-chi/chi/v5":         "chi",
+		"gopkg.in/yaml.v3":                 "yaml",
+		"gopkg.in/DataDog/dd-trace-go.v1":  "dd-trace-go",
+		"github.com/jonbodner/orchestrion": "orchestrion",
+	} {
+		name, err := packageNames{}.ResolvePackage(path)
+		require.NoError(t, err)
+		require.Equal(t, want, name, path)
+	}
+}
+
+func TestReportClients(t *testing.T) {
+	var code = `package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	resp, err := http.Get("http://example.com")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+}
+
+func fetch(ctx context.Context, client *http.Client) error {
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		return err
+	}
+	if _, err := client.Do(req); err != nil {
+		return err
+	}
+	_, err = client.Post("http://example.com", "text/plain", strings.NewReader("hello"))
+	go func() {
+		http.PostForm("http://example.com", url.Values{})
+	}()
+	return err
+}
+
+func head(req *http.Request) (*http.Response, error) {
+	return http.DefaultClient.Do(req)
+}
+
+func get(url string) (*http.Response, error) {
+	return http.Get(url)
+}
+`
+	var want = `package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	//dd:startinstrument v2 mode=report
+	r = r.WithContext(instrument.Report(r.Context(), instrument.EventStart, "name", "handler", "verb", r.Method))
+	defer instrument.Report(r.Context(), instrument.EventEnd, "name", "handler", "verb", r.Method)
+	//dd:endinstrument
+	//dd:startwrap v2 mode=report
+	resp, err := instrument.HTTPGet(r.Context(), nil, "http://example.com")
+	//dd:endwrap
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+}
+
+func fetch(ctx context.Context, client *http.Client) error {
+	//dd:instrumented
+	//dd:startwrap v2 mode=report
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+	//dd:endwrap
+	//dd:startinstrument v2 mode=report
+	if req != nil {
+		req = req.WithContext(instrument.Report(req.Context(), instrument.EventCall, "name", req.URL, "verb", req.Method))
+		req = instrument.InsertHeader(req)
+		defer instrument.Report(req.Context(), instrument.EventReturn, "name", req.URL, "verb", req.Method)
+	}
+	//dd:endinstrument
+	if err != nil {
+		return err
+	}
+	if _, err := client.Do(req); err != nil {
+		return err
+	}
+	//dd:startwrap v2 mode=report
+	_, err = instrument.HTTPPost(ctx, client, "http://example.com", "text/plain", strings.NewReader("hello"))
+	//dd:endwrap
+	go func() {
+		//dd:startwrap v2 mode=report
+		instrument.HTTPPostForm(ctx, nil, "http://example.com", url.Values{})
+		//dd:endwrap
+	}()
+	return err
+}
+
+func head(req *http.Request) (*http.Response, error) {
+	//dd:startwrap v2 mode=report
+	return instrument.HTTPDo(http.DefaultClient, req)
+	//dd:endwrap
+}
+
+func get(url string) (*http.Response, error) {
+	//dd:startwrap v2 mode=report
+	return instrument.HTTPGet(context.Background(), nil, url)
+	//dd:endwrap
+}
+`
+	conf := config.Config{HTTPMode: "report", Instrumentation: "console"}
+	reader, err := InstrumentFile("test", strings.NewReader(code), conf)
+	require.NoError(t, err)
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, want, string(got))
+
+	reader, err = UninstrumentFile("test", strings.NewReader(want), conf)
+	require.NoError(t, err)
+	orig, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, code, string(orig))
+}
+
+func TestReportClientsTwice(t *testing.T) {
+	var code = `package main
+
+import (
+	"context"
+	"net/http"
+)
+
+func fetch(ctx context.Context, c http.Client, u string) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp, err := http.DefaultClient.Get(u); err == nil {
+		resp.Body.Close()
+	}
+	switch resp, err := c.Head(u); {
+	case err != nil:
+		return err
+	default:
+		resp.Body.Close()
+	}
+	return nil
+}
+`
+	var want = `package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+func fetch(ctx context.Context, c http.Client, u string) error {
+	//dd:instrumented
+	//dd:startwrap v2 mode=report
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	//dd:endwrap
+	//dd:startinstrument v2 mode=report
+	if req != nil {
+		req = req.WithContext(instrument.Report(req.Context(), instrument.EventCall, "name", req.URL, "verb", req.Method))
+		req = instrument.InsertHeader(req)
+		defer instrument.Report(req.Context(), instrument.EventReturn, "name", req.URL, "verb", req.Method)
+	}
+	//dd:endinstrument
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	//dd:startwrap v2 mode=report
+	if resp, err := instrument.HTTPGet(ctx, http.DefaultClient, u); err == nil {
+		resp.Body.Close()
+	}
+	//dd:endwrap
+	//dd:startwrap v2 mode=report
+	switch resp, err := instrument.HTTPHead(ctx, &c, u); {
+	case err != nil:
+		return err
+	default:
+		resp.Body.Close()
+	}
+	//dd:endwrap
+	return nil
+}
+`
+	conf := config.Config{HTTPMode: "report", Instrumentation: "console"}
+	got := code
+	// the requests reported by the first run are not reported again by the second
+	for i := 0; i < 2; i++ {
+		reader, err := InstrumentFile("test", strings.NewReader(got), conf)
+		require.NoError(t, err)
+		out, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		got = string(out)
+		require.Equal(t, want, got, "run %d", i+1)
+	}
+
+	reader, err := UninstrumentFile("test", strings.NewReader(want), conf)
+	require.NoError(t, err)
+	orig, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, code, string(orig))
+}
+
+func TestUnwrapNestedRequests(t *testing.T) {
+	// the requests created in the body of a wrapped statement are left as written
+	var code = `package main
+
+import (
+	"context"
+	"net/http"
+)
+
+func fetch(ctx context.Context, ctx2 context.Context, u string) {
+	if resp, err := http.Get(u); err == nil {
+		resp.Body.Close()
+		req, _ := http.NewRequestWithContext(ctx2, http.MethodGet, u, nil)
+		_ = req
+	}
+}
+`
+	conf := config.Config{HTTPMode: "report", Instrumentation: "console"}
+	reader, err := InstrumentFile("test", strings.NewReader(code), conf)
+	require.NoError(t, err)
+	instrumented, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Contains(t, string(instrumented), "instrument.HTTPGet(ctx, nil, u)")
+	require.Contains(t, string(instrumented), "http.NewRequestWithContext(ctx2, http.MethodGet, u, nil)")
+
+	reader, err = UninstrumentFile("test", strings.NewReader(string(instrumented)), conf)
+	require.NoError(t, err)
+	orig, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, code, string(orig))
+}
+
+func TestWrapClientLiterals(t *testing.T) {
+	var code = `package main
+
+import (
+	"net/http"
+	"time"
+)
+
+var client = &http.Client{Timeout: time.Second}
+
+type service struct {
+	client *http.Client
+}
+
+func newService() *service {
+	return &service{
+		client: &http.Client{Timeout: time.Second},
+	}
+}
+
+func newClient() *http.Client {
+	return &http.Client{}
+}
+
+func run() {
+	var c = &http.Client{}
+	use(c, &http.Client{
+		Timeout: time.Second,
+	})
+	go func() {
+		use(&http.Client{})
+	}()
+}
+
+func main() {
+	run()
+}
+`
+	var want = `package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+//dd:startwrap v2 mode=wrap
+var client = instrument.WrapHTTPClient(&http.Client{Timeout: time.Second})
+
+//dd:endwrap
+
+type service struct {
+	client *http.Client
+}
+
+func newService() *service {
+	//dd:startwrap v2 mode=wrap
+	return &service{
+		client: instrument.WrapHTTPClient(&http.Client{Timeout: time.Second}),
+	}
+	//dd:endwrap
+}
+
+func newClient() *http.Client {
+	//dd:startwrap v2 mode=wrap
+	return instrument.WrapHTTPClient(&http.Client{})
+	//dd:endwrap
+}
+
+func run() {
+	//dd:startwrap v2 mode=wrap
+	var c = instrument.WrapHTTPClient(&http.Client{})
+	//dd:endwrap
+	//dd:startwrap v2 mode=wrap
+	use(c, instrument.WrapHTTPClient(&http.Client{
+		Timeout: time.Second,
+	}))
+	//dd:endwrap
+	//dd:startwrap v2 mode=wrap
+	go func() {
+		use(instrument.WrapHTTPClient(&http.Client{}))
+	}()
+	//dd:endwrap
+}
+
+func main() {
+	//dd:startinstrument v2 mode=wrap
+	defer instrument.Init(orchestrionTarget)()
+	http.DefaultClient = instrument.WrapHTTPClient(http.DefaultClient)
+	//dd:endinstrument
+	run()
+}
+
+//dd:startinstrument v2 target=console
+var orchestrionTarget = "console"
+
+//dd:endinstrument
+`
+	conf := config.Config{HTTPMode: "wrap", Instrumentation: "console", WrapDefaultClient: true}
+	reader, err := InstrumentFile("test", strings.NewReader(code), conf)
+	require.NoError(t, err)
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, want, string(got))
+
+	reader, err = UninstrumentFile("test", strings.NewReader(want), conf)
+	require.NoError(t, err)
+	orig, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, code, string(orig))
+}
+
+func TestReportHandlerMethods(t *testing.T) {
+	var code = `package main
+
+import (
+	"net/http"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+type UserAPI struct{}
+
+func (a *UserAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+type OrderAPI struct{}
+
+func (OrderAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func register(mux *http.ServeMux) {
+	mux.Handle("/users", &UserAPI{})
+	mux.Handle("/orders", instrument.WrapHandler(OrderAPI{}, "/orders"))
+}
+`
+	var want = `package main
+
+import (
+	"net/http"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+
+type UserAPI struct{}
+
+func (a *UserAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//dd:startinstrument v2 mode=report
+	r = r.WithContext(instrument.Report(r.Context(), instrument.EventStart, "name", "*UserAPI.ServeHTTP", "verb", r.Method))
+	defer instrument.Report(r.Context(), instrument.EventEnd, "name", "*UserAPI.ServeHTTP", "verb", r.Method)
+	//dd:endinstrument
+	w.WriteHeader(http.StatusOK)
+}
+
+type OrderAPI struct{}
+
+func (OrderAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func register(mux *http.ServeMux) {
+	mux.Handle("/users", &UserAPI{})
+	mux.Handle("/orders", instrument.WrapHandler(OrderAPI{}, "/orders"))
+}
+`
+	conf := config.Config{HTTPMode: "report", Instrumentation: "console"}
+	reader, err := InstrumentFile("test", strings.NewReader(code), conf)
+	require.NoError(t, err)
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, want, string(got))
+
+	reader, err = UninstrumentFile("test", strings.NewReader(want), conf)
+	require.NoError(t, err)
+	orig, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, code, string(orig))
+}
+
+func TestReportHandlerMethodsAcrossPackages(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": `module example.com/app
+
+go 1.19
+
+require gopkg.in/DataDog/dd-trace-go.v1 v1.52.0
+
+replace gopkg.in/DataDog/dd-trace-go.v1 => ./ddtrace
+`,
+		// a stand-in for the http integration of dd-trace-go
+		"ddtrace/go.mod": "module gopkg.in/DataDog/dd-trace-go.v1\n\ngo 1.19\n",
+		"ddtrace/contrib/net/http/http.go": `package http
+
+import "net/http"
+
+func WrapHandler(h http.Handler, service, resource string) http.Handler { return h }
+`,
+		"api/api.go": `package api
+
+import "net/http"
+
+type UserAPI struct{}
+
+func (a *UserAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {}
+
+type OrderAPI struct{}
+
+func (a *OrderAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {}
+`,
+		"main.go": `package main
+
+import (
+	"net/http"
+
+	httptrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/net/http"
+
+	"example.com/app/api"
+)
+
+func main() {
+	http.Handle("/users", httptrace.WrapHandler(&api.UserAPI{}, "app", "/users"))
+	http.Handle("/orders", &api.OrderAPI{})
+}
+`,
+	}
+	for name, src := range files {
+		name = filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+		require.NoError(t, os.WriteFile(name, []byte(src), 0644))
+	}
+	got := map[string]string{}
+	output := func(name string, r io.Reader) {
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		got[filepath.Base(name)] = string(b)
+	}
+	conf := config.Config{HTTPMode: "report", Instrumentation: "console"}
+	require.NoError(t, ProcessPackage(dir, InstrumentFile, output, conf))
+	// UserAPI is wrapped where it is registered, in package main
+	require.NotContains(t, got["api.go"], `"*UserAPI.ServeHTTP"`)
+	require.Contains(t, got["api.go"], `"*OrderAPI.ServeHTTP"`)
+}
+
+func TestDirectivePrefix(t *testing.T) {
+	code := `package main
+
+import "context"
+
+//orchestrion:span
+func doThing(ctx context.Context) {}
+
+//dd:span
+func doOther(ctx context.Context) {}
+`
+	conf := config.Config{HTTPMode: "wrap", Instrumentation: "console", Prefix: "orchestrion"}
+	reader, err := InstrumentFile("test", strings.NewReader(code), conf)
+	require.NoError(t, err)
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Contains(t, string(got), "//orchestrion:span\nfunc doThing")
+	require.Contains(t, string(got), "//dd:span\nfunc doOther")
+	require.Contains(t, string(got), "//orchestrion:startinstrument v2")
+	require.NotContains(t, string(got), "//dd:startinstrument")
+
+	// the directives of both prefixes are recognized, whatever the prefix
+	for _, prefix := range []string{"", "dd", "orchestrion", "acme"} {
+		t.Run("uninstrument "+prefix, func(t *testing.T) {
+			conf.Prefix = prefix
+			reader, err := UninstrumentFile("test", strings.NewReader(string(got)), conf)
+			require.NoError(t, err)
+			orig, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, code, string(orig))
+		})
+	}
+
+	t.Run("custom", func(t *testing.T) {
+		conf := config.Config{HTTPMode: "wrap", Instrumentation: "console", Prefix: "acme"}
+		src := strings.ReplaceAll(code, "//orchestrion:span", "//acme:span")
+		reader, err := InstrumentFile("test", strings.NewReader(src), conf)
+		require.NoError(t, err)
+		got, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Contains(t, string(got), "//acme:startinstrument v2")
+
+		reader, err = UninstrumentFile("test", strings.NewReader(string(got)), conf)
+		require.NoError(t, err)
+		orig, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, src, string(orig))
+	})
+}
+
+func TestProjectConfig(t *testing.T) {
+	code := `package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+)
+
+//dd:span
+func HandleOrder(ctx context.Context) {}
+
+func main() {
+	db, _ := sql.Open("postgres", "")
+	_ = db
+	http.HandleFunc("/orders", nil)
+}
+`
+	conf := config.Config{
+		HTTPMode:        "wrap",
+		Instrumentation: "dd",
+		Service:         "checkout",
+		Integrations:    []string{"sql"},
+		Spans:           []config.SpanName{{Function: "Handle*", Name: "handler.{function}"}},
+	}
+	reader, err := InstrumentFile("test", strings.NewReader(code), conf)
+	require.NoError(t, err)
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	require.Contains(t, string(got), `instrument.Report(ctx, instrument.EventStart, "function-name", "handler.HandleOrder")`)
+	require.Contains(t, string(got), `defer instrument.Init(orchestrionTarget, "checkout")()`)
+	require.Contains(t, string(got), `db, _ := instrument.Open("postgres", "")`)
+	// the http integration is disabled
+	require.Contains(t, string(got), `http.HandleFunc("/orders", nil)`)
+	require.NotContains(t, string(got), "WrapHandlerFunc")
+
+	reader, err = UninstrumentFile("test", strings.NewReader(string(got)), conf)
+	require.NoError(t, err)
+	orig, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, code, string(orig))
+}
+
+func TestProcessPackageSkips(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.go":                 "package main\n",
+		"main_test.go":            "package main\n",
+		"api/api.pb.go":           "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage api\n",
+		"api/api.go":              "package api\n\n// Code generated by hand. DO NOT EDIT.\n",
+		"vendor/example.com/x.go": "package x\n",
+		"testdata/sample.go":      "package sample\n",
+		".cache/c.go":             "package c\n",
+		"_old/o.go":               "package o\n",
+	}
+	for name, src := range files {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(src), 0644))
+	}
+	var got []string
+	process := func(name string, r io.Reader, conf config.Config) (io.Reader, error) {
+		rel, err := filepath.Rel(dir, name)
+		require.NoError(t, err)
+		got = append(got, filepath.ToSlash(rel))
+		return nil, nil
+	}
+	conf := config.Config{HTTPMode: "wrap", Instrumentation: "console"}
+	require.NoError(t, ProcessPackage(dir, process, nil, conf))
+	require.ElementsMatch(t, []string{"main.go", "main_test.go", "api/api.go"}, got)
+
+	got = nil
+	conf.ExcludeFiles = []string{"*_test.go", "api/*.go"}
+	require.NoError(t, ProcessPackage(dir, process, nil, conf))
+	require.Equal(t, []string{"main.go"}, got)
+}
+
+func TestProcessPackageBuilds(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":  "module example.com/builds\n\ngo 1.19\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+		"client_integration.go": `//go:build integration
+
+package main
+
+import "net/http"
+
+type Client = http.Client
+`,
+		"fetch_integration.go": `//go:build integration
+
+package main
+
+func fetch(c *Client) {
+	c.Get("http://example.com")
+}
+`,
+	}
+	for name, src := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(src), 0644))
+	}
+	got := map[string]string{}
+	output := func(name string, r io.Reader) {
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		got[filepath.Base(name)] = string(b)
+	}
+	conf := config.Config{HTTPMode: "report", Instrumentation: "console"}
+	require.NoError(t, ProcessPackage(dir, InstrumentFile, output, conf))
+	// Client is known from the other file of the integration build.
+	require.Contains(t, got["fetch_integration.go"], `instrument.HTTPGet(context.Background(), c, "http://example.com")`)
+}
+
+func TestVariantOf(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go":         "package p\n",
+		"a_windows.go": "package p\n",
+		"b.go":         "//go:build linux && integration\n\npackage p\n",
+		"c.go":         "//go:build ignore\n\npackage p\n",
+	}
+	for name, src := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(src), 0644))
+	}
+	base := typechecker.Build{GOOS: "linux", GOARCH: "amd64"}
+	variant := func(name string) (typechecker.Build, bool) {
+		return variantOf(base, filepath.Join(dir, name), []byte(files[name]))
+	}
+
+	_, ok := variant("a.go")
+	require.False(t, ok)
+	b, ok := variant("a_windows.go")
+	require.True(t, ok)
+	require.Equal(t, typechecker.Build{GOOS: "windows", GOARCH: "amd64", Tags: []string{}}, b)
+	b, ok = variant("b.go")
+	require.True(t, ok)
+	require.Equal(t, typechecker.Build{GOOS: "linux", GOARCH: "amd64", Tags: []string{"integration"}}, b)
+	_, ok = variant("c.go")
+	require.False(t, ok)
+}
+
+func TestProcessPatterns(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":                 "module example.com/patterns\n\ngo 1.19\n",
+		"cmd/a/main.go":          "package main\n\nfunc main() {}\n",
+		"cmd/a/main_test.go":     "package main\n",
+		"cmd/b/main.go":          "package main\n\nfunc main() {}\n",
+		"internal/api/api.go":    "package api\n",
+		"internal/api/v2/api.go": "package v2\n",
+		"lib/lib.go":             "package lib\n",
+	}
+	for name, src := range files {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(src), 0644))
+	}
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	var got []string
+	process := func(name string, r io.Reader, conf config.Config) (io.Reader, error) {
+		rel, err := filepath.Rel(dir, name)
+		require.NoError(t, err)
+		got = append(got, filepath.ToSlash(rel))
+		return nil, nil
+	}
+	conf := config.Config{HTTPMode: "wrap", Instrumentation: "console"}
+	require.NoError(t, ProcessPatterns([]string{"./cmd/...", "example.com/patterns/internal/api", "./cmd/a"}, process, nil, conf))
+	require.ElementsMatch(t, []string{"cmd/a/main.go", "cmd/a/main_test.go", "cmd/b/main.go", "internal/api/api.go"}, got)
+
+	require.Error(t, ProcessPatterns([]string{"example.com/patterns/missing"}, process, nil, conf))
+}
@@ -0,0 +1,123 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"regexp"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// addLineDirectives adds line directives to f, so that the positions of the
+// original code are preserved once instrumented and compiled from another file.
+// The file starts with a //line directive, and each of the original declarations
+// and statements is preceded by a /*line*/ directive. The inserted code is reported
+// at the line of the declaration it belongs to, or of the package clause, so that it
+// is never mistaken for the original code, and the blocks ending with inserted code
+// restore the line of their closing brace.
+func addLineDirectives(name string, f *dst.File, dec *decorator.Decorator) {
+	line := func(n dst.Node) int {
+		astNode, ok := dec.Ast.Nodes[n]
+		if !ok {
+			return 0
+		}
+		return dec.Fset.Position(astNode.Pos()).Line
+	}
+	directive := func(line int) string {
+		return fmt.Sprintf("/*line %s:%d*/", name, line)
+	}
+	// stmts adds the directives of list, the statements of a block in a declaration at
+	// the line owner.
+	stmts := func(list []dst.Stmt, owner int) {
+		for _, stmt := range list {
+			if _, ok := stmt.(*dst.EmptyStmt); ok {
+				continue
+			}
+			l := line(stmt)
+			if l == 0 {
+				l = owner
+				if decs := stmt.Decorations(); decs.Before == dst.None && len(decs.Start) == 0 {
+					// the directive must start the line of the inserted statement
+					decs.Before = dst.NewLine
+				}
+			}
+			stmt.Decorations().Start.Append(directive(l))
+		}
+	}
+
+	f.Decs.Start.Prepend(fmt.Sprintf("//line %s:1", name))
+	pkg := 1
+	if file, ok := dec.Ast.Nodes[f].(*ast.File); ok {
+		pkg = dec.Fset.Position(file.Package).Line
+	}
+	for _, decl := range f.Decls {
+		owner := line(decl)
+		if owner == 0 {
+			owner = pkg
+		}
+		decl.Decorations().Start.Append(directive(owner))
+		dst.Inspect(decl, func(n dst.Node) bool {
+			switch n := n.(type) {
+			case *dst.BlockStmt:
+				stmts(n.List, owner)
+				block, ok := dec.Ast.Nodes[n].(*ast.BlockStmt)
+				if ok && len(n.List) > 0 && endsInserted(n.List[len(n.List)-1], dec) {
+					end := &lastStmt(n.List[len(n.List)-1]).Decorations().End
+					if all := end.All(); len(all) == 0 || !strings.HasPrefix(all[len(all)-1], "//") {
+						// the directive is printed on its own line, like after a line comment
+						end.Append("\n")
+					}
+					end.Append(directive(dec.Fset.Position(block.Rbrace).Line))
+				}
+			case *dst.CaseClause:
+				stmts(n.Body, owner)
+			case *dst.CommClause:
+				stmts(n.Body, owner)
+			}
+			return true
+		})
+	}
+}
+
+// lastStmt returns the last statement of the code of stmt, in the bodies of the clauses.
+func lastStmt(stmt dst.Stmt) dst.Stmt {
+	var body []dst.Stmt
+	switch stmt := stmt.(type) {
+	case *dst.CaseClause:
+		body = stmt.Body
+	case *dst.CommClause:
+		body = stmt.Body
+	}
+	if len(body) == 0 {
+		return stmt
+	}
+	return lastStmt(body[len(body)-1])
+}
+
+// endsInserted reports whether the code of stmt ends with a statement inserted by the
+// instrumentation, which has no original position in dec.
+func endsInserted(stmt dst.Stmt, dec *decorator.Decorator) bool {
+	_, ok := dec.Ast.Nodes[lastStmt(stmt)]
+	return !ok
+}
+
+// ownLineDirective matches the /*line*/ directives printed on their own line.
+var ownLineDirective = regexp.MustCompile(`[ \t]*(/\*line [^*\n]*\*/)\n([ \t]*)`)
+
+// spacedLineDirective matches the /*line*/ directives printed before a space.
+var spacedLineDirective = regexp.MustCompile(`(/\*line [^*\n]*\*/) `)
+
+// fixLineDirectives moves the /*line*/ directives printed on their own line to the
+// start of the next one: a directive applies to the position immediately following it.
+// The directives are printed right before the code they apply to.
+func fixLineDirectives(src []byte) []byte {
+	src = ownLineDirective.ReplaceAll(src, []byte("${2}${1}"))
+	return spacedLineDirective.ReplaceAll(src, []byte("${1}"))
+}
@@ -0,0 +1,215 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package instrument
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jonbodner/orchestrion/internal/config"
+
+	"github.com/dave/dst"
+)
+
+// generatorVersion is the version of the code inserted by orchestrion, recorded by
+// the start markers, e.g. //dd:startinstrument v2. It must be incremented when the
+// shape of the inserted code changes, so that orchestrion upgrade replaces the code
+// inserted by older versions. The markers without version are version 1.
+const generatorVersion = 2
+
+// The markers added by code that depends on the configuration record it as
+// key=value attributes, e.g. //dd:startwrap v2 mode=wrap.
+const (
+	modeAttr   = "mode"
+	targetAttr = "target"
+)
+
+// startMarker returns the start marker label, recording the generator version and attrs.
+func startMarker(label string, attrs ...string) string {
+	out := fmt.Sprintf("%s v%d", label, generatorVersion)
+	for _, attr := range attrs {
+		out += " " + attr
+	}
+	return out
+}
+
+// withMode returns the start marker label recording the HTTP mode that produced it.
+// Markers that don't depend on the HTTP mode have an empty mode.
+func withMode(label, mode string) string {
+	if mode == "" {
+		return startMarker(label)
+	}
+	return startMarker(label, modeAttr+"="+mode)
+}
+
+// withTarget returns the start marker label recording the target that produced it.
+func withTarget(label, target string) string {
+	return startMarker(label, targetAttr+"="+target)
+}
+
+// markerVersion returns the generator version recorded by the marker comment.
+func markerVersion(comment string) int {
+	fields := strings.Fields(comment)
+	if len(fields) > 1 && strings.HasPrefix(fields[1], "v") {
+		if v, err := strconv.Atoi(fields[1][1:]); err == nil {
+			return v
+		}
+	}
+	return 1
+}
+
+// markerAttr returns the value of the attribute key of the marker comment, if any.
+func markerAttr(comment, key string) string {
+	fields := strings.Fields(comment)
+	if len(fields) > 0 {
+		fields = fields[1:]
+	}
+	for _, f := range fields {
+		if k, v, ok := strings.Cut(f, "="); ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// conflictingMarkers returns a description of the configuration recorded by the
+// markers of f, when it differs from conf, e.g. "httpmode wrap".
+// Markers without attributes, from older versions, never conflict.
+func conflictingMarkers(f *dst.File, conf config.Config) (string, bool) {
+	var out string
+	dst.Inspect(f, func(n dst.Node) bool {
+		if n == nil || out != "" {
+			return false
+		}
+		decs := n.Decorations()
+		for _, c := range append(decs.Start.All(), decs.End.All()...) {
+			if !strings.HasPrefix(c, "//dd:") {
+				continue
+			}
+			if mode := markerAttr(c, modeAttr); conf.HTTPMode != "" && mode != "" && mode != conf.HTTPMode {
+				out = fmt.Sprintf("httpmode %s", mode)
+				return false
+			}
+			if target := markerAttr(c, targetAttr); conf.Instrumentation != "" && target != "" && target != conf.Instrumentation {
+				out = fmt.Sprintf("target %s", target)
+				return false
+			}
+		}
+		return true
+	})
+	return out, out != ""
+}
+
+// outdatedMarkers reports whether f holds start markers written by an older version
+// of the generator.
+func outdatedMarkers(f *dst.File) bool {
+	outdated := false
+	dst.Inspect(f, func(n dst.Node) bool {
+		if n == nil || outdated {
+			return false
+		}
+		for _, c := range n.Decorations().Start.All() {
+			if isStartMarker(c) && markerVersion(c) < generatorVersion {
+				outdated = true
+				return false
+			}
+		}
+		return true
+	})
+	return outdated
+}
+
+// isStartMarker reports whether the comment c starts a block of inserted code.
+func isStartMarker(c string) bool {
+	fields := strings.Fields(c)
+	return len(fields) > 0 && (fields[0] == dd_startinstrument || fields[0] == dd_startwrap)
+}
+
+// directiveNames are the names of the directives orchestrion reads and writes,
+// e.g. span for //dd:span.
+var directiveNames = map[string]bool{
+	"span":            true,
+	"ignore":          true,
+	"startinstrument": true,
+	"endinstrument":   true,
+	"startwrap":       true,
+	"endwrap":         true,
+	"instrumented":    true,
+}
+
+// defaultPrefix is the prefix of the directives, as handled internally.
+const defaultPrefix = "dd"
+
+// directives records the prefixes of the directives of a file, e.g. orchestrion for
+// //orchestrion:span, so that they are written back as they were.
+type directives map[*dst.NodeDecs]map[string]string
+
+// readDirectives replaces the prefix of the directives of f by dd, for the prefixes
+// recognized with conf: dd, orchestrion, and conf.Prefix.
+func readDirectives(f *dst.File, conf config.Config) directives {
+	prefixes := []string{defaultPrefix, "orchestrion", conf.Prefix}
+	ds := directives{}
+	eachDirective(f, func(decs *dst.NodeDecs, c string) string {
+		for _, prefix := range prefixes {
+			if prefix == "" {
+				continue
+			}
+			if _, ok := directiveName(c, prefix); ok {
+				canonical := "//" + defaultPrefix + ":" + strings.TrimPrefix(c, "//"+prefix+":")
+				if ds[decs] == nil {
+					ds[decs] = map[string]string{}
+				}
+				ds[decs][canonical] = c
+				return canonical
+			}
+		}
+		return c
+	})
+	return ds
+}
+
+// write writes back the directives of f read by readDirectives, and gives conf.Prefix
+// to the directives added since.
+func (ds directives) write(f *dst.File, conf config.Config) {
+	eachDirective(f, func(decs *dst.NodeDecs, c string) string {
+		if _, ok := directiveName(c, defaultPrefix); !ok {
+			return c
+		}
+		if orig, ok := ds[decs][c]; ok {
+			return orig
+		}
+		if conf.Prefix != "" && conf.Prefix != defaultPrefix {
+			return "//" + conf.Prefix + ":" + strings.TrimPrefix(c, "//"+defaultPrefix+":")
+		}
+		return c
+	})
+}
+
+// eachDirective replaces the comments c of the nodes of f by replace(decs, c).
+func eachDirective(f *dst.File, replace func(decs *dst.NodeDecs, c string) string) {
+	dst.Inspect(f, func(n dst.Node) bool {
+		if n == nil {
+			return false
+		}
+		decs := n.Decorations()
+		for _, d := range []*dst.Decorations{&decs.Start, &decs.End} {
+			for i, c := range *d {
+				(*d)[i] = replace(decs, c)
+			}
+		}
+		return true
+	})
+}
+
+// directiveName returns the name of the directive c with the prefix prefix, if it is one.
+func directiveName(c, prefix string) (string, bool) {
+	if !strings.HasPrefix(c, "//"+prefix+":") {
+		return "", false
+	}
+	name, _, _ := strings.Cut(strings.TrimPrefix(c, "//"+prefix+":"), " ")
+	return name, directiveNames[name]
+}
@@ -0,0 +1,32 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package instrument
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/dave/dst/decorator/resolver/goast"
+)
+
+// majorVersion matches the major version suffixes of import paths, e.g. /v5 or .v3.
+var majorVersion = regexp.MustCompile(`[/.]v[0-9]+$`)
+
+// packageNames guesses the names of the imported packages from their paths, like guess.RestorerResolver,
+// ignoring the major versions: github.com/go-chi/chi/v5 is chi and gopkg.in/yaml.v3 is yaml.
+type packageNames struct{}
+
+func (packageNames) ResolvePackage(importPath string) (string, error) {
+	if i := majorVersion.FindStringIndex(importPath); i != nil && strings.Contains(importPath[:i[0]], "/") {
+		importPath = importPath[:i[0]]
+	}
+	return importPath[strings.LastIndex(importPath, "/")+1:], nil
+}
+
+// newIdentResolver returns the resolver of the identifiers of decorated files.
+func newIdentResolver() *goast.DecoratorResolver {
+	return goast.WithResolver(packageNames{})
+}
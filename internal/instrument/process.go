@@ -0,0 +1,213 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package instrument
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jonbodner/orchestrion/internal/config"
+	"github.com/jonbodner/orchestrion/internal/typechecker"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// processor processes the files of packages, each one once.
+type processor struct {
+	process ProcessFunc
+	output  OutputFunc
+	conf    config.Config
+	// base is the build the files are type checked for.
+	base typechecker.Build
+	// variants records the directories loaded for other builds than base.
+	variants map[string]bool
+	// done records the files processed.
+	done map[string]bool
+}
+
+func newProcessor(process ProcessFunc, output OutputFunc, conf config.Config) *processor {
+	return &processor{
+		process:  process,
+		output:   output,
+		conf:     conf,
+		base:     buildOf(conf),
+		variants: map[string]bool{},
+		done:     map[string]bool{},
+	}
+}
+
+// walk processes the files of the tree of the directory root.
+func (p *processor) walk(root string) error {
+	return fs.WalkDir(os.DirFS(root), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("couldn't walk path: %w", err)
+		}
+		if d.IsDir() {
+			if path != "." && skipDir(d.Name()) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		return p.file(root + string(os.PathSeparator) + path)
+	})
+}
+
+// dir processes the files of the directory name, without its subdirectories.
+func (p *processor) dir(name string) error {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return fmt.Errorf("couldn't read directory: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if err := p.file(filepath.Join(name, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// file processes the file name, unless it is excluded or was already processed.
+func (p *processor) file(name string) error {
+	if filepath.Ext(name) != ".go" || !p.conf.IncludesFile(name) {
+		return nil
+	}
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return fmt.Errorf("sanitizing path (%s) failed: %w", name, err)
+	}
+	if p.done[name] {
+		return nil
+	}
+	p.done[name] = true
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	if IsGenerated(name, src) {
+		return nil
+	}
+	// The files of other builds, e.g. x_windows.go or //go:build integration, are
+	// checked with the files of the first variant of the build selecting them.
+	if b, ok := variantOf(p.base, name, src); ok {
+		dir := filepath.Dir(name)
+		if key := fmt.Sprint(dir, b); !p.variants[key] {
+			p.variants[key] = true
+			if err := typechecker.LoadBuild(b, dir, "."); err != nil {
+				log.Printf("Type information unavailable for %s: %v", name, err)
+			}
+		}
+	}
+	// The files outside of the loaded packages have no import path,
+	// and are processed with conf as is.
+	conf := p.conf
+	if pkgPath := typechecker.PackagePath(name); pkgPath != "" {
+		if !conf.Includes(pkgPath) {
+			return nil
+		}
+		conf = conf.For(pkgPath)
+	}
+	out, err := p.process(name, bytes.NewReader(src), conf)
+	if err != nil {
+		return fmt.Errorf("error scanning file %s: %w", name, err)
+	}
+	if out != nil {
+		p.output(name, out)
+	}
+	return nil
+}
+
+// IsPattern reports whether the argument arg is a package pattern, e.g. ./cmd/... or
+// example.com/app/api, rather than a directory.
+func IsPattern(arg string) bool {
+	if strings.Contains(arg, "...") {
+		return true
+	}
+	fi, err := os.Stat(arg)
+	return err != nil || !fi.IsDir()
+}
+
+// ProcessPatterns processes the files of the packages selected by args. The directories
+// are processed along with their subdirectories, like ProcessPackage, and the other
+// arguments are package patterns resolved like the go command does from the current
+// directory, e.g. ./cmd/... or example.com/app/api. Each file is processed once.
+func ProcessPatterns(args []string, process ProcessFunc, output OutputFunc, conf config.Config) error {
+	p := newProcessor(process, output, conf)
+	var patterns []string
+	for _, arg := range args {
+		if IsPattern(arg) {
+			patterns = append(patterns, arg)
+			continue
+		}
+		if err := typechecker.LoadBuild(p.base, arg, "./..."); err != nil {
+			log.Printf("Type information unavailable, files will be checked in isolation: %v", err)
+		}
+		if err := p.walk(arg); err != nil {
+			return err
+		}
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+	dirs, err := resolvePatterns(p.base, patterns)
+	if err != nil {
+		return err
+	}
+	if err := typechecker.LoadBuild(p.base, "", patterns...); err != nil {
+		log.Printf("Type information unavailable, files will be checked in isolation: %v", err)
+	}
+	for _, dir := range dirs {
+		if err := p.dir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolvePatterns returns the directories of the packages matching patterns for the build b,
+// in order and without duplicates.
+func resolvePatterns(b typechecker.Build, patterns []string) ([]string, error) {
+	cfg := b.Config("")
+	cfg.Mode = packages.NeedName | packages.NeedFiles
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %w", strings.Join(patterns, " "), err)
+	}
+	var dirs []string
+	seen := map[string]bool{}
+	for _, pkg := range pkgs {
+		if strings.HasSuffix(pkg.ID, ".test") {
+			// the generated main package of the tests, in the build cache
+			continue
+		}
+		var files []string
+		for _, list := range [][]string{pkg.GoFiles, pkg.IgnoredFiles, pkg.OtherFiles} {
+			files = append(files, list...)
+		}
+		if len(files) == 0 {
+			if len(pkg.Errors) > 0 {
+				return nil, fmt.Errorf("package %s: %v", pkg.PkgPath, pkg.Errors[0])
+			}
+			continue
+		}
+		dir := filepath.Dir(files[0])
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no packages match %s", strings.Join(patterns, " "))
+	}
+	return dirs, nil
+}
@@ -0,0 +1,377 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package instrument
+
+import (
+	"fmt"
+	"go/token"
+	"log"
+	"strings"
+
+	"github.com/jonbodner/orchestrion/internal/config"
+	"github.com/jonbodner/orchestrion/internal/rules"
+	"github.com/jonbodner/orchestrion/internal/typechecker"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// activeRules returns the rules that apply with conf.
+func activeRules(conf config.Config) []rules.Rule {
+	var out []rules.Rule
+	for _, rs := range [][]rules.Rule{rules.Builtin, conf.Rules} {
+		for _, r := range rs {
+			if (r.Mode == "" || r.Mode == conf.HTTPMode) && conf.Enabled(r.Integration) {
+				out = append(out, r)
+			}
+		}
+	}
+	return out
+}
+
+// applyRules rewrites the calls made by stmt that match a rule.
+// Wrapped statements are surrounded by //dd:startwrap and //dd:endwrap, and so are the
+// wrapped fields of composite literals.
+// It returns the statements to insert before stmt, if any.
+func applyRules(stmt dst.Stmt, tc *typechecker.TypeChecker, conf config.Config) []dst.Stmt {
+	var (
+		wrapped bool
+		before  []dst.Stmt
+		// mode is the HTTP mode of the rules applied, if any
+		mode string
+	)
+	for _, r := range activeRules(conf) {
+		if r.Match.Field != "" {
+			for _, lit := range literalsOf(stmt) {
+				wrapField(lit, r, tc)
+			}
+			continue
+		}
+		for _, call := range callsOf(stmt) {
+			if !matchCall(call, r.Match, tc) {
+				continue
+			}
+			if r.Mode != "" {
+				mode = r.Mode
+			}
+			if r.Action.Kind == rules.PrependStatements {
+				before = append(before, buildStatements(r)...)
+				continue
+			}
+			applyAction(call, r.Action)
+			wrapped = true
+		}
+		if assign, ok := stmt.(*dst.AssignStmt); ok && matchAssign(assign, r.Match, tc) && !isWrapped(assign.Rhs[0], r.Action) {
+			assign.Rhs[0] = &dst.CallExpr{
+				Fun:  &dst.Ident{Name: r.Action.Function, Path: r.Action.Package},
+				Args: []dst.Expr{assign.Rhs[0]},
+			}
+			if r.Mode != "" {
+				mode = r.Mode
+			}
+			wrapped = true
+		}
+	}
+	if wrapped {
+		markWrapped(stmt, mode)
+	}
+	if len(before) > 0 {
+		before[0].Decorations().Before = dst.NewLine
+		before[0].Decorations().Start.Prepend(withMode(dd_startinstrument, mode))
+		before[len(before)-1].Decorations().After = dst.NewLine
+		before[len(before)-1].Decorations().End.Append("\n", dd_endinstrument)
+		stmt.Decorations().Start.Prepend(dd_instrumented)
+	}
+	return before
+}
+
+// isWrapped reports whether expr is already wrapped by the function of a.
+func isWrapped(expr dst.Expr, a rules.Action) bool {
+	call, ok := expr.(*dst.CallExpr)
+	return ok && isCallTo(call, a.Package, a.Function)
+}
+
+// markWrapped surrounds stmt by //dd:startwrap and //dd:endwrap, unless it already is.
+// The start marker records mode, the HTTP mode of the wrapper, if any.
+func markWrapped(stmt dst.Stmt, mode string) {
+	if hasLabel(dd_startwrap, stmt.Decorations().Start.All()) {
+		return
+	}
+	stmt.Decorations().Start.Append(withMode(dd_startwrap, mode))
+	stmt.Decorations().End.Append("\n", dd_endwrap)
+	if _, ok := stmt.(*dst.ReturnStmt); ok {
+		stmt.Decorations().Before = dst.NewLine
+	}
+}
+
+// callsOf returns the calls made at the top level of stmt.
+func callsOf(stmt dst.Stmt) []*dst.CallExpr {
+	var exprs []dst.Expr
+	switch stmt := stmt.(type) {
+	case *dst.AssignStmt:
+		exprs = stmt.Rhs
+	case *dst.ExprStmt:
+		exprs = []dst.Expr{stmt.X}
+	case *dst.ReturnStmt:
+		exprs = stmt.Results
+	}
+	var out []*dst.CallExpr
+	for _, expr := range exprs {
+		if call, ok := expr.(*dst.CallExpr); ok {
+			out = append(out, call)
+		}
+	}
+	return out
+}
+
+// literalsOf returns the composite literals, or their addresses, assigned or returned by stmt.
+func literalsOf(stmt dst.Stmt) []*dst.CompositeLit {
+	var exprs []dst.Expr
+	switch stmt := stmt.(type) {
+	case *dst.AssignStmt:
+		exprs = stmt.Rhs
+	case *dst.ReturnStmt:
+		exprs = stmt.Results
+	}
+	var out []*dst.CompositeLit
+	for _, expr := range exprs {
+		if u, ok := expr.(*dst.UnaryExpr); ok && u.Op == token.AND {
+			expr = u.X
+		}
+		if lit, ok := expr.(*dst.CompositeLit); ok {
+			out = append(out, lit)
+		}
+	}
+	return out
+}
+
+// wrapField wraps the value of the field of lit selected by the rule r, if lit is of its type.
+// The field is surrounded by //dd:startwrap and //dd:endwrap.
+func wrapField(lit *dst.CompositeLit, r rules.Rule, tc *typechecker.TypeChecker) {
+	if !isType(lit.Type, r.Match.Package, r.Match.Type) && tc.TypeOf(lit) != r.Match.Package+"."+r.Match.Type {
+		return
+	}
+	for _, e := range lit.Elts {
+		kv, ok := e.(*dst.KeyValueExpr)
+		if !ok || !isField(kv, r.Match.Field) {
+			continue
+		}
+		if hasLabel(dd_startwrap, kv.Decorations().Start.All()) || isWrapped(kv.Value, r.Action) {
+			return
+		}
+		kv.Decorations().Start.Append(withMode(dd_startwrap, r.Mode))
+		kv.Decorations().End.Append("\n", dd_endwrap)
+		kv.Value = &dst.CallExpr{
+			Fun:  &dst.Ident{Name: r.Action.Function, Path: r.Action.Package},
+			Args: []dst.Expr{kv.Value},
+		}
+		return
+	}
+}
+
+// isField reports whether kv sets the field name.
+func isField(kv *dst.KeyValueExpr, name string) bool {
+	k, ok := kv.Key.(*dst.Ident)
+	return ok && k.Name == name
+}
+
+// matchCall reports whether call is a call to the function or method selected by m.
+func matchCall(call *dst.CallExpr, m rules.Match, tc *typechecker.TypeChecker) bool {
+	if m.Function == "" || (m.Args != 0 && len(call.Args) != m.Args) {
+		return false
+	}
+	switch f := call.Fun.(type) {
+	case *dst.Ident:
+		return m.Type == "" && f.Path == m.Package && f.Name == m.Function
+	case *dst.SelectorExpr:
+		return m.Type != "" && f.Sel.Name == m.Function && hasType(f.X, m.Package, m.Type, tc)
+	}
+	return false
+}
+
+// matchAssign reports whether stmt assigns a single variable of the type selected by m.
+func matchAssign(stmt *dst.AssignStmt, m rules.Match, tc *typechecker.TypeChecker) bool {
+	if m.Function != "" || m.Field != "" || !(len(stmt.Lhs) == 1 && len(stmt.Rhs) == 1) {
+		return false
+	}
+	iden, ok := stmt.Lhs[0].(*dst.Ident)
+	return ok && hasType(iden, m.Package, m.Type, tc)
+}
+
+// hasType reports whether expr is of type path.name, or a pointer to it.
+func hasType(expr dst.Expr, path, name string, tc *typechecker.TypeChecker) bool {
+	return isType(expr, path, name) ||
+		strings.TrimPrefix(tc.TypeOf(expr), "*") == path+"."+name
+}
+
+func applyAction(call *dst.CallExpr, a rules.Action) {
+	switch a.Kind {
+	case rules.WrapArgument:
+		if a.Argument >= len(call.Args) {
+			return
+		}
+		args := []dst.Expr{call.Args[a.Argument]}
+		for _, i := range a.Arguments {
+			if i < len(call.Args) && isConstant(call.Args[i]) {
+				args = append(args, dst.Clone(call.Args[i]).(dst.Expr))
+			}
+		}
+		call.Args[a.Argument] = &dst.CallExpr{
+			Fun:  &dst.Ident{Name: a.Function, Path: a.Package},
+			Args: args,
+		}
+	case rules.WrapResult:
+		inner := &dst.CallExpr{Fun: call.Fun, Args: call.Args, Ellipsis: call.Ellipsis}
+		call.Fun = &dst.Ident{Name: a.Function, Path: a.Package}
+		call.Args = []dst.Expr{inner}
+		call.Ellipsis = false
+	case rules.AppendArguments:
+		for _, f := range a.Functions {
+			call.Args = append(call.Args, &dst.CallExpr{Fun: &dst.Ident{Name: f, Path: a.Package}})
+		}
+	case rules.ReplaceFunction:
+		call.Fun = &dst.Ident{Name: a.Function, Path: a.Package}
+	}
+}
+
+// isConstant reports whether evaluating expr twice is safe: it is a literal, a name,
+// a selector or a concatenation of them, e.g. "GET " + prefix + "/users".
+func isConstant(expr dst.Expr) bool {
+	switch expr := expr.(type) {
+	case *dst.BasicLit, *dst.Ident:
+		return true
+	case *dst.SelectorExpr:
+		return isConstant(expr.X)
+	case *dst.ParenExpr:
+		return isConstant(expr.X)
+	case *dst.BinaryExpr:
+		return expr.Op == token.ADD && isConstant(expr.X) && isConstant(expr.Y)
+	}
+	return false
+}
+
+// buildStatements parses the statements inserted by a PrependStatements rule.
+func buildStatements(r rules.Rule) []dst.Stmt {
+	var src strings.Builder
+	src.WriteString("package rule\n\nimport (\n")
+	fmt.Fprintf(&src, "\tinstrument %q\n", rules.RuntimePackage)
+	for name, path := range r.Action.Imports {
+		fmt.Fprintf(&src, "\t%s %q\n", name, path)
+	}
+	src.WriteString(")\n\nfunc _() {\n")
+	for _, stmt := range r.Action.Statements {
+		src.WriteString(stmt + "\n")
+	}
+	src.WriteString("}\n")
+
+	dec := decorator.NewDecoratorWithImports(token.NewFileSet(), "rule", newIdentResolver())
+	f, err := dec.Parse(src.String())
+	if err != nil {
+		log.Printf("rule %q: invalid statements: %v", r.Name, err)
+		return nil
+	}
+	return f.Decls[len(f.Decls)-1].(*dst.FuncDecl).Body.List
+}
+
+// unwrapRule returns the unwrapper removing what r adds, to be used in dst.Inspect.
+// Statements added by PrependStatements are removed along with their //dd:startinstrument block.
+// The receivers of the methods are checked with tc, when their type is known.
+func unwrapRule(r rules.Rule, tc *typechecker.TypeChecker) func(n dst.Node) bool {
+	return func(n dst.Node) bool {
+		switch n := n.(type) {
+		case *dst.CallExpr:
+			unwrapCall(n, r, tc)
+		case *dst.CompositeLit:
+			unwrapField(n, r)
+		case *dst.AssignStmt:
+			if r.Match.Function != "" || r.Match.Field != "" || len(n.Rhs) != 1 {
+				return true
+			}
+			if ce, ok := n.Rhs[0].(*dst.CallExpr); ok && isCallTo(ce, r.Action.Package, r.Action.Function) && len(ce.Args) == 1 {
+				n.Rhs[0] = ce.Args[0]
+			}
+		}
+		return true
+	}
+}
+
+// unwrapField removes the wrapper of the field of lit selected by the rule r, if it is
+// surrounded by //dd:startwrap and //dd:endwrap, along with the markers.
+func unwrapField(lit *dst.CompositeLit, r rules.Rule) {
+	if r.Match.Field == "" || !isType(lit.Type, r.Match.Package, r.Match.Type) {
+		return
+	}
+	for _, e := range lit.Elts {
+		kv, ok := e.(*dst.KeyValueExpr)
+		if !ok || !isField(kv, r.Match.Field) || !hasLabel(dd_startwrap, kv.Decorations().Start.All()) {
+			continue
+		}
+		if ce, ok := kv.Value.(*dst.CallExpr); ok && isCallTo(ce, r.Action.Package, r.Action.Function) && len(ce.Args) == 1 {
+			kv.Value = ce.Args[0]
+		}
+		kv.Decorations().Start.Replace(removeDecl(dd_startwrap, kv.Decorations().Start)...)
+		kv.Decorations().End.Replace(removeDecl(dd_endwrap, kv.Decorations().End)...)
+	}
+}
+
+func unwrapCall(call *dst.CallExpr, r rules.Rule, tc *typechecker.TypeChecker) {
+	a := r.Action
+	if a.Kind == rules.ReplaceFunction {
+		if isCallTo(call, a.Package, a.Function) {
+			call.Fun = &dst.Ident{Name: r.Match.Function, Path: r.Match.Package}
+		}
+		return
+	}
+	if a.Kind == rules.WrapResult {
+		if !isCallTo(call, a.Package, a.Function) || len(call.Args) != 1 {
+			return
+		}
+		if inner, ok := call.Args[0].(*dst.CallExpr); ok && matchesCall(inner, r.Match, tc) {
+			call.Fun, call.Args, call.Ellipsis = inner.Fun, inner.Args, inner.Ellipsis
+		}
+		return
+	}
+	if !matchesCall(call, r.Match, tc) {
+		return
+	}
+	switch a.Kind {
+	case rules.WrapArgument:
+		if a.Argument >= len(call.Args) {
+			return
+		}
+		if ce, ok := call.Args[a.Argument].(*dst.CallExpr); ok && isCallTo(ce, a.Package, a.Function) && len(ce.Args) >= 1 {
+			call.Args[a.Argument] = ce.Args[0]
+		}
+	case rules.AppendArguments:
+		for i := len(a.Functions) - 1; i >= 0 && len(call.Args) > 0; i-- {
+			if ce, ok := call.Args[len(call.Args)-1].(*dst.CallExpr); ok && isCallTo(ce, a.Package, a.Functions[i]) {
+				call.Args = call.Args[:len(call.Args)-1]
+			}
+		}
+	}
+}
+
+// matchesCall reports whether call is a call to the function or method selected by m.
+// The type of the receiver is checked with tc. When it is unknown, inside a
+// //dd:startwrap block, a matching method name is enough.
+func matchesCall(call *dst.CallExpr, m rules.Match, tc *typechecker.TypeChecker) bool {
+	switch f := call.Fun.(type) {
+	case *dst.Ident:
+		return m.Type == "" && f.Path == m.Package && f.Name == m.Function
+	case *dst.SelectorExpr:
+		if m.Type == "" || f.Sel.Name != m.Function {
+			return false
+		}
+		return tc.TypeOf(f.X) == "" || hasType(f.X, m.Package, m.Type, tc)
+	}
+	return false
+}
+
+// isCallTo reports whether call calls the function path.name.
+func isCallTo(call *dst.CallExpr, path, name string) bool {
+	f, ok := call.Fun.(*dst.Ident)
+	return ok && f.Path == path && f.Name == name
+}
@@ -18,7 +18,7 @@ import (
 )
 
 func main() {
-	//dd:startinstrument
+	//dd:startinstrument v2
 	defer instrument.Init(orchestrionTarget)()
 	//dd:endinstrument
 	var s *http.ServeMux = http.NewServeMux()
@@ -26,7 +26,7 @@ func main() {
 }
 
 func myHandler(w http.ResponseWriter, r *http.Request) {
-	//dd:startinstrument
+	//dd:startinstrument v2 mode=report
 	r = r.WithContext(instrument.Report(r.Context(), instrument.EventStart, "name", "myHandler", "verb", r.Method))
 	defer instrument.Report(r.Context(), instrument.EventEnd, "name", "myHandler", "verb", r.Method)
 	//dd:endinstrument
@@ -49,7 +49,7 @@ func myClient() {
 	req, err := http.NewRequestWithContext(context.Background(),
 		http.MethodPost, "http://localhost:8080",
 		strings.NewReader(os.Args[1]))
-	//dd:startinstrument
+	//dd:startinstrument v2 mode=report
 	if req != nil {
 		req = req.WithContext(instrument.Report(req.Context(), instrument.EventCall, "name", req.URL, "verb", req.Method))
 		req = instrument.InsertHeader(req)
@@ -74,7 +74,7 @@ func myClient() {
 	fmt.Println(string(b))
 }
 
-//dd:startinstrument
+//dd:startinstrument v2 target=console
 var orchestrionTarget = "console"
 
 //dd:endinstrument
@@ -18,12 +18,12 @@ import (
 )
 
 func main() {
-	//dd:startinstrument
+	//dd:startinstrument v2
 	defer instrument.Init(orchestrionTarget)()
 	//dd:endinstrument
 	var s *http.ServeMux = http.NewServeMux()
-	//dd:startwrap
-	s.HandleFunc("/handle", instrument.WrapHandlerFunc(myHandler))
+	//dd:startwrap v2 mode=wrap
+	s.HandleFunc("/handle", instrument.WrapHandlerFunc(myHandler, "/handle"))
 	//dd:endwrap
 }
 
@@ -40,7 +40,7 @@ func myHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func myClient() {
-	//dd:startwrap
+	//dd:startwrap v2 mode=wrap
 	client := instrument.WrapHTTPClient(&http.Client{
 		Timeout: time.Second,
 	})
@@ -66,7 +66,7 @@ func myClient() {
 	fmt.Println(string(b))
 }
 
-//dd:startinstrument
+//dd:startinstrument v2 target=console
 var orchestrionTarget = "console"
 
 //dd:endinstrument
@@ -8,75 +8,75 @@ package instrument
 import (
 	"bytes"
 	"fmt"
+	"go/parser"
 	"go/token"
 	"io"
 	"log"
 	"strings"
 
 	"github.com/jonbodner/orchestrion/internal/config"
+	"github.com/jonbodner/orchestrion/internal/rules"
+	"github.com/jonbodner/orchestrion/internal/typechecker"
 
 	"github.com/dave/dst"
 	"github.com/dave/dst/decorator"
-	"github.com/dave/dst/decorator/resolver/goast"
-	"github.com/dave/dst/decorator/resolver/guess"
 )
 
-var unwrappers = []func(n dst.Node) bool{
-	unwrapClient,
-	unwrapHandlerExpr,
-	unwrapHandlerAssign,
-	unwrapSqlExpr,
-	unwrapSqlAssign,
-	unwrapSqlReturn,
-	unwrapGRPC,
+// unwrappersFor returns the functions removing the wrappers added by the rules of conf,
+// whatever their HTTP mode. The method calls are matched with the types of tc.
+func unwrappersFor(conf config.Config, tc *typechecker.TypeChecker) []func(n dst.Node) bool {
+	out := []func(n dst.Node) bool{unwrapClientCall, unwrapClientLiteral}
+	for _, rs := range [][]rules.Rule{rules.Builtin, conf.Rules} {
+		for _, r := range rs {
+			out = append(out, unwrapRule(r, tc))
+		}
+	}
+	return out
 }
 
 func UninstrumentFile(name string, r io.Reader, conf config.Config) (io.Reader, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", name, err)
+	}
 	fset := token.NewFileSet()
-	d := decorator.NewDecoratorWithImports(fset, name, goast.New())
-	f, err := d.Parse(r)
+	astFile, err := parser.ParseFile(fset, name, src, parser.ParseComments)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing content in %s: %w", name, err)
 	}
+	d := decorator.NewDecoratorWithImports(fset, name, newIdentResolver())
+	f, err := d.DecorateFile(astFile)
+	if err != nil {
+		return nil, fmt.Errorf("error decorating file %s: %w", name, err)
+	}
 
+	ds := readDirectives(f, conf)
+
+	tc := typechecker.New(d)
+	tc.Check(name, src, fset, astFile)
+	unwrappers := unwrappersFor(conf, tc)
 	outDecls := make([]dst.Decl, 0, len(f.Decls))
-	for _, decl := range f.Decls {
+	for i, decl := range f.Decls {
 		if decl, ok := decl.(*dst.FuncDecl); ok {
-			decl.Body.List = removeStartEndWrap(decl.Body.List)
-			decl.Body.List = removeStartEndInstrument(decl.Body.List)
-			// recurse for function literals
-			for _, stmt := range decl.Body.List {
-				switch stmt := stmt.(type) {
-				case *dst.AssignStmt:
-					for _, expr := range stmt.Rhs {
-						if compLit, ok := expr.(*dst.CompositeLit); ok {
-							for _, v := range compLit.Elts {
-								if kv, ok := v.(*dst.KeyValueExpr); ok {
-									if funLit, ok := kv.Value.(*dst.FuncLit); ok {
-										funLit.Body.List = removeStartEndWrap(funLit.Body.List)
-										funLit.Body.List = removeStartEndInstrument(funLit.Body.List)
-									}
-								}
-							}
-						}
-						if funLit, ok := expr.(*dst.FuncLit); ok {
-							funLit.Body.List = removeStartEndWrap(funLit.Body.List)
-							funLit.Body.List = removeStartEndInstrument(funLit.Body.List)
-						}
-					}
-				case *dst.ExprStmt:
-					if call, ok := stmt.X.(*dst.CallExpr); ok {
-						switch funLit := call.Fun.(type) {
-						case *dst.FuncLit:
-							funLit.Body.List = removeStartEndWrap(funLit.Body.List)
-							funLit.Body.List = removeStartEndInstrument(funLit.Body.List)
-						}
-					}
-				}
+			if hasLabel(dd_span, decl.Decorations().Start.All()) {
+				unnameErrorResult(decl.Type)
 			}
+			uninstrumentBlocks(decl.Body, unwrappers)
 		}
 		// if this is a decorated constant, don't include it
 		if decl, ok := decl.(*dst.GenDecl); ok {
+			if decl.Tok == token.VAR && hasLabel(dd_startwrap, decl.Decs.Start.All()) {
+				decl.Decs.Start.Replace(removeDecl(dd_startwrap, decl.Decs.Start)...)
+				decl.Decs.End.Replace(removeDecl(dd_endwrap, decl.Decs.End)...)
+				if i+1 < len(f.Decls) {
+					// once parsed, //dd:endwrap is before the next declaration
+					next := f.Decls[i+1].Decorations()
+					next.Start.Replace(removeDecl(dd_endwrap, next.Start)...)
+				}
+				for _, unwrap := range unwrappers {
+					dst.Inspect(decl, unwrap)
+				}
+			}
 			if decl.Tok == token.VAR {
 				decs := decl.Decs.Start
 				found := false
@@ -95,13 +95,38 @@ func UninstrumentFile(name string, r io.Reader, conf config.Config) (io.Reader,
 		outDecls = append(outDecls, decl)
 	}
 	f.Decls = outDecls
+	ds.write(f, conf)
 
-	res := decorator.NewRestorerWithImports(name, guess.New())
+	res := decorator.NewRestorerWithImports(name, packageNames{})
 	var out bytes.Buffer
 	err = res.Fprint(&out, f)
 	return &out, err
 }
 
+// uninstrumentBlocks removes the instrumentation of body and of the blocks nested in it,
+// including the bodies of function literals.
+func uninstrumentBlocks(body *dst.BlockStmt, unwrappers []func(n dst.Node) bool) {
+	dst.Inspect(body, func(n dst.Node) bool {
+		switch n := n.(type) {
+		case *dst.BlockStmt:
+			n.List = removeStartEndWrap(n.List, unwrappers)
+			n.List = removeStartEndInstrument(n.List)
+		case *dst.CaseClause:
+			n.Body = removeStartEndWrap(n.Body, unwrappers)
+			n.Body = removeStartEndInstrument(n.Body)
+		case *dst.CommClause:
+			n.Body = removeStartEndWrap(n.Body, unwrappers)
+			n.Body = removeStartEndInstrument(n.Body)
+		case *dst.CompositeLit:
+			// the wrapped fields have their own //dd:startwrap and //dd:endwrap
+			for _, unwrap := range unwrappers {
+				unwrap(n)
+			}
+		}
+		return true
+	})
+}
+
 func removeDecl(prefix string, ds dst.Decorations) []string {
 	var rds []string
 	for i := range ds {
@@ -118,7 +143,7 @@ func removeDecoration(deco string, s dst.Stmt) {
 	s.Decorations().End.Replace(removeDecl(deco, s.Decorations().End)...)
 }
 
-func removeStartEndWrap(list []dst.Stmt) []dst.Stmt {
+func removeStartEndWrap(list []dst.Stmt, unwrappers []func(n dst.Node) bool) []dst.Stmt {
 	unwrap := func(l []dst.Stmt) {
 		for _, s := range l {
 			for _, unwrap := range unwrappers {
@@ -179,168 +204,3 @@ func removeStartEndInstrument(list []dst.Stmt) []dst.Stmt {
 	}
 	return list
 }
-
-// unwrapClient unwraps client, to be used in dst.Inspect.
-// Returns true to continue the traversal, false to stop.
-func unwrapClient(n dst.Node) bool {
-	s, ok := n.(*dst.AssignStmt)
-	if !ok {
-		return true
-	}
-	ce, ok := s.Rhs[0].(*dst.CallExpr)
-	if !ok {
-		return true
-	}
-	cei, ok := ce.Fun.(*dst.Ident)
-	if !ok {
-		return true
-	}
-	if cei.Path == "github.com/jonbodner/orchestrion/instrument" && strings.HasPrefix(cei.Name, "WrapHTTPClient") {
-		s.Rhs[0] = ce.Args[0]
-		return false
-	}
-	return true
-}
-
-// unwrapHandlerExpr unwraps handler expressions, to be used in dst.Inspect.
-// Returns true to continue the traversal, false to stop.
-func unwrapHandlerExpr(n dst.Node) bool {
-	es, ok := n.(*dst.ExprStmt)
-	if !ok {
-		return true
-	}
-	f, ok := es.X.(*dst.CallExpr)
-	if !ok {
-		return true
-	}
-	if len(f.Args) > 1 {
-		if ce, ok := f.Args[1].(*dst.CallExpr); ok {
-			if cei, ok := ce.Fun.(*dst.Ident); ok {
-				if cei.Path == "github.com/jonbodner/orchestrion/instrument" &&
-					strings.HasPrefix(cei.Name, "WrapHandler") {
-					// This catches both WrapHandler *and* WrapHandlerFunc
-					f.Args[1] = ce.Args[0]
-					return false
-				}
-			}
-		}
-	}
-	return true
-}
-
-// unwrapHandlerAssign unwraps handler assignements, to be used in dst.Inspect.
-// Returns true to continue the traversal, false to stop.
-func unwrapHandlerAssign(n dst.Node) bool {
-	// TODO: Implement me
-	return false
-}
-
-func unwrapSqlExpr(n dst.Node) bool {
-	es, ok := n.(*dst.ExprStmt)
-	if !ok {
-		return true
-	}
-	f, ok := es.X.(*dst.CallExpr)
-	if !ok {
-		return true
-	}
-	id, ok := f.Fun.(*dst.Ident)
-	if !ok {
-		return true
-	}
-	if id.Path == "github.com/jonbodner/orchestrion/instrument" &&
-		(id.Name == "Open" || id.Name == "OpenDB") {
-		id.Path = "database/sql"
-		return true
-	}
-	return true
-}
-
-func unwrapSqlAssign(n dst.Node) bool {
-	as, ok := n.(*dst.AssignStmt)
-	if !ok {
-		return true
-	}
-	f, ok := as.Rhs[0].(*dst.CallExpr)
-	if !ok {
-		return true
-	}
-	id, ok := f.Fun.(*dst.Ident)
-	if !ok {
-		return true
-	}
-	if id.Path == "github.com/jonbodner/orchestrion/instrument" &&
-		(id.Name == "Open" || id.Name == "OpenDB") {
-		id.Path = "database/sql"
-		return true
-	}
-	return true
-}
-
-func unwrapSqlReturn(n dst.Node) bool {
-	rs, ok := n.(*dst.ReturnStmt)
-	if !ok {
-		return true
-	}
-	for _, expr := range rs.Results {
-		fun, ok := expr.(*dst.CallExpr)
-		if !ok {
-			continue
-		}
-		f, ok := fun.Fun.(*dst.Ident)
-		if !(ok && f.Path == "github.com/jonbodner/orchestrion/instrument" &&
-			(f.Name == "Open" || f.Name == "OpenDB")) {
-			continue
-		}
-		f.Path = "database/sql"
-	}
-	return true
-}
-
-// unwrapGRPC unwraps grpc server and client, to be used in dst.Inspect.
-// Returns true to continue the traversal, false to stop.
-func unwrapGRPC(n dst.Node) bool {
-	s, ok := n.(*dst.AssignStmt)
-	if !ok {
-		return true
-	}
-	ce, ok := s.Rhs[0].(*dst.CallExpr)
-	if !ok {
-		return true
-	}
-	cei, ok := ce.Fun.(*dst.Ident)
-	if !ok {
-		return true
-	}
-	if cei.Path != "google.golang.org/grpc" || !(cei.Name == "Dial" || cei.Name == "NewServer") || len(ce.Args) == 0 {
-		return true
-	}
-	removeLast := func(args []dst.Expr, targetFunc string) []dst.Expr {
-		if len(args) == 0 {
-			return args
-		}
-		lastArg := args[len(args)-1]
-		lastArgExp, ok := lastArg.(*dst.CallExpr)
-		if !ok {
-			return args
-		}
-		fun, ok := lastArgExp.Fun.(*dst.Ident)
-		if !ok {
-			return args
-		}
-		if !(fun.Path == "github.com/jonbodner/orchestrion/instrument" && fun.Name == targetFunc) {
-			return args
-		}
-		return args[:len(args)-1]
-	}
-	removable := []string{
-		"GRPCUnaryServerInterceptor",
-		"GRPCStreamServerInterceptor",
-		"GRPCUnaryClientInterceptor",
-		"GRPCStreamClientInterceptor",
-	}
-	for _, opt := range removable {
-		ce.Args = removeLast(ce.Args, opt)
-	}
-	return true
-}
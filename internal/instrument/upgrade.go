@@ -0,0 +1,39 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package instrument
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/jonbodner/orchestrion/internal/config"
+
+	"github.com/dave/dst/decorator"
+)
+
+// UpgradeFile replaces the code inserted by older versions of orchestrion: the
+// instrumentation of the file is removed, and the file is instrumented again with conf.
+// The files without outdated markers are left alone, and it returns a nil reader for them.
+func UpgradeFile(name string, r io.Reader, conf config.Config) (io.Reader, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", name, err)
+	}
+	f, err := decorator.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing content in %s: %w", name, err)
+	}
+	readDirectives(f, conf)
+	if !outdatedMarkers(f) {
+		return nil, nil
+	}
+	orig, err := UninstrumentFile(name, bytes.NewReader(src), conf)
+	if err != nil {
+		return nil, fmt.Errorf("error upgrading %s: %w", name, err)
+	}
+	return InstrumentFile(name, orig, conf)
+}
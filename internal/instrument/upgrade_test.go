@@ -0,0 +1,42 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package instrument
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jonbodner/orchestrion/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgradeFile(t *testing.T) {
+	conf := config.Config{HTTPMode: "report", Instrumentation: "console"}
+	want, err := os.ReadFile("./testdata/http_reported.go")
+	require.NoError(t, err)
+
+	// the markers of version 1 had no version nor attributes, and the requests
+	// were reported with "url" and "method" keys
+	old := regexp.MustCompile(`(//dd:start\w+) .*`).ReplaceAllString(string(want), "$1")
+	old = strings.NewReplacer(`"name", req.URL, "verb"`, `"url", req.URL, "method"`).Replace(old)
+	require.NotEqual(t, string(want), old)
+
+	reader, err := UpgradeFile("test", strings.NewReader(old), conf)
+	require.NoError(t, err)
+	require.NotNil(t, reader)
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, string(want), string(got))
+
+	// up to date
+	reader, err = UpgradeFile("test", strings.NewReader(string(want)), conf)
+	require.NoError(t, err)
+	require.Nil(t, reader)
+}
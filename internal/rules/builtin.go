@@ -0,0 +1,140 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package rules
+
+// The packages instrumenting the routers, in the orchestrion runtime.
+const (
+	chiPackage  = RuntimePackage + "/chitrace"
+	echoPackage = RuntimePackage + "/echotrace"
+	ginPackage  = RuntimePackage + "/gintrace"
+	muxPackage  = RuntimePackage + "/muxtrace"
+)
+
+// The integrations of the builtin rules, which can be enabled separately.
+const (
+	GRPCIntegration    = "grpc"
+	SQLIntegration     = "sql"
+	HTTPIntegration    = "http"
+	ChiIntegration     = "chi"
+	EchoIntegration    = "echo"
+	GinIntegration     = "gin"
+	GorillaIntegration = "gorilla"
+)
+
+// Integrations lists the integrations of the builtin rules.
+var Integrations = []string{GRPCIntegration, SQLIntegration, HTTPIntegration, ChiIntegration, EchoIntegration, GinIntegration, GorillaIntegration}
+
+// Builtin holds the rules for the libraries orchestrion supports out of the box.
+var Builtin = []Rule{
+	{
+		Name:        "grpc-server",
+		Integration: GRPCIntegration,
+		Match:       Match{Package: "google.golang.org/grpc", Function: "NewServer"},
+		Action:      Action{Kind: AppendArguments, Package: RuntimePackage, Functions: []string{"GRPCStreamServerInterceptor", "GRPCUnaryServerInterceptor"}},
+	},
+	{
+		Name:        "grpc-client",
+		Integration: GRPCIntegration,
+		Match:       Match{Package: "google.golang.org/grpc", Function: "Dial"},
+		Action:      Action{Kind: AppendArguments, Package: RuntimePackage, Functions: []string{"GRPCStreamClientInterceptor", "GRPCUnaryClientInterceptor"}},
+	},
+	{
+		Name:        "sql-open",
+		Integration: SQLIntegration,
+		Match:       Match{Package: "database/sql", Function: "Open"},
+		Action:      Action{Kind: ReplaceFunction, Package: RuntimePackage, Function: "Open"},
+	},
+	{
+		Name:        "sql-opendb",
+		Integration: SQLIntegration,
+		Match:       Match{Package: "database/sql", Function: "OpenDB"},
+		Action:      Action{Kind: ReplaceFunction, Package: RuntimePackage, Function: "OpenDB"},
+	},
+	{
+		Name:        "http-handle",
+		Integration: HTTPIntegration,
+		Mode:        "wrap",
+		Match:       Match{Package: "net/http", Function: "Handle", Args: 2},
+		Action:      Action{Kind: WrapArgument, Package: RuntimePackage, Function: "WrapHandler", Argument: 1, Arguments: []int{0}},
+	},
+	{
+		Name:        "http-handlefunc",
+		Integration: HTTPIntegration,
+		Mode:        "wrap",
+		Match:       Match{Package: "net/http", Function: "HandleFunc", Args: 2},
+		Action:      Action{Kind: WrapArgument, Package: RuntimePackage, Function: "WrapHandlerFunc", Argument: 1, Arguments: []int{0}},
+	},
+	{
+		Name:        "http-servemux-handle",
+		Integration: HTTPIntegration,
+		Mode:        "wrap",
+		Match:       Match{Package: "net/http", Type: "ServeMux", Function: "Handle", Args: 2},
+		Action:      Action{Kind: WrapArgument, Package: RuntimePackage, Function: "WrapHandler", Argument: 1, Arguments: []int{0}},
+	},
+	{
+		Name:        "http-servemux-handlefunc",
+		Integration: HTTPIntegration,
+		Mode:        "wrap",
+		Match:       Match{Package: "net/http", Type: "ServeMux", Function: "HandleFunc", Args: 2},
+		Action:      Action{Kind: WrapArgument, Package: RuntimePackage, Function: "WrapHandlerFunc", Argument: 1, Arguments: []int{0}},
+	},
+	{
+		Name:        "http-server-handler",
+		Integration: HTTPIntegration,
+		Mode:        "wrap",
+		Match:       Match{Package: "net/http", Type: "Server", Field: "Handler"},
+		Action:      Action{Kind: WrapArgument, Package: RuntimePackage, Function: "WrapHandler"},
+	},
+	{
+		Name:        "http-client",
+		Integration: HTTPIntegration,
+		Mode:        "wrap",
+		Match:       Match{Package: "net/http", Type: "Client"},
+		Action:      Action{Kind: WrapArgument, Package: RuntimePackage, Function: "WrapHTTPClient"},
+	},
+	{
+		Name:        "chi-newrouter",
+		Integration: ChiIntegration,
+		Mode:        "wrap",
+		Match:       Match{Package: "github.com/go-chi/chi/v5", Function: "NewRouter"},
+		Action:      Action{Kind: WrapResult, Package: chiPackage, Function: "WrapRouter"},
+	},
+	{
+		Name:        "chi-newmux",
+		Integration: ChiIntegration,
+		Mode:        "wrap",
+		Match:       Match{Package: "github.com/go-chi/chi/v5", Function: "NewMux"},
+		Action:      Action{Kind: WrapResult, Package: chiPackage, Function: "WrapRouter"},
+	},
+	{
+		Name:        "echo-new",
+		Integration: EchoIntegration,
+		Mode:        "wrap",
+		Match:       Match{Package: "github.com/labstack/echo/v4", Function: "New"},
+		Action:      Action{Kind: WrapResult, Package: echoPackage, Function: "WrapRouter"},
+	},
+	{
+		Name:        "gin-new",
+		Integration: GinIntegration,
+		Mode:        "wrap",
+		Match:       Match{Package: "github.com/gin-gonic/gin", Function: "New"},
+		Action:      Action{Kind: WrapResult, Package: ginPackage, Function: "WrapRouter"},
+	},
+	{
+		Name:        "gin-default",
+		Integration: GinIntegration,
+		Mode:        "wrap",
+		Match:       Match{Package: "github.com/gin-gonic/gin", Function: "Default"},
+		Action:      Action{Kind: WrapResult, Package: ginPackage, Function: "WrapRouter"},
+	},
+	{
+		Name:        "gorilla-newrouter",
+		Integration: GorillaIntegration,
+		Mode:        "wrap",
+		Match:       Match{Package: "github.com/gorilla/mux", Function: "NewRouter"},
+		Action:      Action{Kind: WrapResult, Package: muxPackage, Function: "WrapRouter"},
+	},
+}
@@ -0,0 +1,71 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package rules
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// Context describes how to get and replace the context held by a parameter type,
+// for the functions with a //dd:span comment and no context.Context parameter.
+// In Get and Set, $param stands for the parameter. In Set, $ctx stands for the new context.
+type Context struct {
+	// Type is the type of the parameter, e.g. *github.com/gin-gonic/gin.Context.
+	Type string `yaml:"type"`
+	// Get is the Go expression returning the context of the parameter.
+	Get string `yaml:"get"`
+	// Set is the Go statement replacing the context of the parameter.
+	Set string `yaml:"set"`
+}
+
+// BuiltinContexts are the contexts of the supported parameter types.
+var BuiltinContexts = []Context{
+	{
+		Type: "*net/http.Request",
+		Get:  "$param.Context()",
+		Set:  "$param = $param.WithContext($ctx)",
+	},
+	{
+		Type: "*github.com/gin-gonic/gin.Context",
+		Get:  "$param.Request.Context()",
+		Set:  "$param.Request = $param.Request.WithContext($ctx)",
+	},
+	{
+		Type: "github.com/labstack/echo/v4.Context",
+		Get:  "$param.Request().Context()",
+		Set:  "$param.SetRequest($param.Request().WithContext($ctx))",
+	},
+}
+
+// Expand returns the Go source of code, a Get or Set field of c, for the parameter param
+// and the context ctx.
+func (c Context) Expand(code, param, ctx string) string {
+	return strings.NewReplacer("$param", param, "$ctx", ctx).Replace(code)
+}
+
+// Validate checks that the context is complete, and that Get and Set are valid Go code.
+func (c Context) Validate() error {
+	if c.Type == "" {
+		return fmt.Errorf("context: missing type")
+	}
+	if !strings.Contains(c.Get, "$param") {
+		return fmt.Errorf("context %s: get must use $param", c.Type)
+	}
+	if _, err := parser.ParseExpr(c.Expand(c.Get, "param", "ctx")); err != nil {
+		return fmt.Errorf("context %s: invalid get: %w", c.Type, err)
+	}
+	if !strings.Contains(c.Set, "$param") || !strings.Contains(c.Set, "$ctx") {
+		return fmt.Errorf("context %s: set must use $param and $ctx", c.Type)
+	}
+	src := "package p\n\nfunc _() {\n" + c.Expand(c.Set, "param", "ctx") + "\n}\n"
+	if _, err := parser.ParseFile(token.NewFileSet(), "", src, 0); err != nil {
+		return fmt.Errorf("context %s: invalid set: %w", c.Type, err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+// Package rules describes the injection points orchestrion instruments.
+// A rule matches calls to a function (or method) and says how to rewrite them.
+// The same rule is used to add the instrumentation and to remove it.
+package rules
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RuntimePackage is the import path of the orchestrion runtime, used by
+// actions that don't specify a package.
+const RuntimePackage = "github.com/jonbodner/orchestrion/instrument"
+
+// Rule describes an injection point.
+type Rule struct {
+	// Name identifies the rule in logs.
+	Name string `yaml:"name"`
+	// Mode, if set, restricts the rule to the given HTTP mode ("wrap" or "report").
+	Mode string `yaml:"mode"`
+	// Integration, if set, is the integration the rule belongs to, e.g. "http":
+	// the rule only applies when the integration is enabled.
+	Integration string `yaml:"integration"`
+	// Match selects the code the rule applies to.
+	Match Match `yaml:"match"`
+	// Action describes how the matched code is rewritten.
+	Action Action `yaml:"action"`
+}
+
+// Match selects calls to a function, or to a method of a type.
+// When Function is empty, it selects the values assigned to variables of the type instead,
+// or with Field, the values of the field in the composite literals of the type.
+type Match struct {
+	// Package is the import path of the package declaring the function or type.
+	Package string `yaml:"package"`
+	// Type is the name of the type declaring the method, or of the assigned variable.
+	Type string `yaml:"type"`
+	// Function is the name of the function or method.
+	Function string `yaml:"function"`
+	// Field is the name of the field of Type whose values are selected, e.g. Handler in
+	// http.Server{Handler: h}.
+	Field string `yaml:"field"`
+	// Args, if not zero, is the number of arguments the call must have.
+	Args int `yaml:"args"`
+}
+
+// Kind is the kind of rewrite an Action performs.
+type Kind string
+
+const (
+	// WrapArgument passes the argument at index Argument to Function, and uses the result instead.
+	// For assignments and fields, the assigned value is wrapped.
+	WrapArgument Kind = "wrap-argument"
+	// WrapResult passes the result of the call to Function, and uses its result instead.
+	WrapResult Kind = "wrap-result"
+	// AppendArguments appends the results of calling each of Functions to the call arguments.
+	AppendArguments Kind = "append-arguments"
+	// ReplaceFunction calls Function instead of the matched function.
+	ReplaceFunction Kind = "replace-function"
+	// PrependStatements inserts Statements before the statement holding the call.
+	PrependStatements Kind = "prepend-statements"
+)
+
+// Action describes how matched code is rewritten.
+type Action struct {
+	Kind Kind `yaml:"kind"`
+	// Package is the import path of Function and Functions. It defaults to RuntimePackage.
+	Package string `yaml:"package"`
+	// Function is the wrapper of WrapArgument and WrapResult, and the replacement of ReplaceFunction.
+	Function string `yaml:"function"`
+	// Argument is the index of the argument wrapped by WrapArgument.
+	Argument int `yaml:"argument"`
+	// Arguments are the indexes of other call arguments WrapArgument passes to Function after
+	// the wrapped one, e.g. the pattern of a route. They are left out when they may have side effects.
+	Arguments []int `yaml:"arguments"`
+	// Functions are the functions called to build the arguments of AppendArguments.
+	Functions []string `yaml:"functions"`
+	// Statements is the Go source of the statements inserted by PrependStatements.
+	// The orchestrion runtime is available as "instrument", other packages must be listed in Imports.
+	Statements []string `yaml:"statements"`
+	// Imports maps the package names used in Statements to their import paths.
+	Imports map[string]string `yaml:"imports"`
+}
+
+// Validate checks that the rule is complete, and sets the defaults of its action.
+func (r *Rule) Validate() error {
+	if r.Match.Package == "" {
+		return fmt.Errorf("rule %q: match has no package", r.Name)
+	}
+	if r.Match.Function == "" && r.Match.Type == "" {
+		return fmt.Errorf("rule %q: match needs a function or a type", r.Name)
+	}
+	if r.Match.Field != "" && (r.Match.Type == "" || r.Match.Function != "") {
+		return fmt.Errorf("rule %q: a field needs a type and no function", r.Name)
+	}
+	switch r.Mode {
+	case "", "wrap", "report":
+		// do nothing
+	default:
+		return fmt.Errorf("rule %q: invalid mode %q, the supported values are wrap or report", r.Name, r.Mode)
+	}
+	if r.Action.Package == "" {
+		r.Action.Package = RuntimePackage
+	}
+	switch r.Action.Kind {
+	case WrapArgument:
+		if r.Action.Function == "" {
+			return fmt.Errorf("rule %q: %s needs a function", r.Name, r.Action.Kind)
+		}
+		for _, i := range r.Action.Arguments {
+			if i < 0 || i == r.Action.Argument {
+				return fmt.Errorf("rule %q: invalid argument index %d", r.Name, i)
+			}
+		}
+	case WrapResult:
+		if r.Action.Function == "" {
+			return fmt.Errorf("rule %q: %s needs a function", r.Name, r.Action.Kind)
+		}
+	case AppendArguments:
+		if len(r.Action.Functions) == 0 {
+			return fmt.Errorf("rule %q: %s needs functions", r.Name, r.Action.Kind)
+		}
+	case ReplaceFunction:
+		if r.Action.Function == "" {
+			return fmt.Errorf("rule %q: %s needs a function", r.Name, r.Action.Kind)
+		}
+		if r.Match.Type != "" {
+			return fmt.Errorf("rule %q: %s only applies to functions", r.Name, r.Action.Kind)
+		}
+	case PrependStatements:
+		if len(r.Action.Statements) == 0 {
+			return fmt.Errorf("rule %q: %s needs statements", r.Name, r.Action.Kind)
+		}
+	default:
+		return fmt.Errorf("rule %q: invalid action %q", r.Name, r.Action.Kind)
+	}
+	if r.Match.Function == "" && r.Action.Kind != WrapArgument {
+		return fmt.Errorf("rule %q: assignments only support %s", r.Name, WrapArgument)
+	}
+	if r.Match.Function == "" && len(r.Action.Arguments) > 0 {
+		return fmt.Errorf("rule %q: assignments have no arguments to pass", r.Name)
+	}
+	return nil
+}
+
+// File is the content of a rules file.
+type File struct {
+	// Rules are the injection points defined in the file.
+	Rules []Rule `yaml:"rules"`
+	// Contexts are the context accessors defined in the file.
+	Contexts []Context `yaml:"contexts"`
+}
+
+// Load reads the rules defined in the YAML file name.
+// The file holds a list of rules under the "rules" key, and a list of contexts
+// under the "contexts" key.
+func Load(name string) (*File, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rules: %w", err)
+	}
+	var file File
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("error parsing rules in %s: %w", name, err)
+	}
+	for i := range file.Rules {
+		if err := file.Rules[i].Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	for _, c := range file.Contexts {
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return &file, nil
+}
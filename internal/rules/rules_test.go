@@ -0,0 +1,115 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "rules.yml")
+	err := os.WriteFile(name, []byte(`rules:
+  - name: redis
+    match:
+      package: github.com/redis/go-redis/v9
+      function: NewClient
+    action:
+      kind: wrap-argument
+      package: github.com/acme/tracing
+      function: WrapOptions
+  - name: cache
+    match:
+      package: github.com/acme/cache
+      type: Cache
+      function: Get
+    action:
+      kind: prepend-statements
+      statements:
+        - instrument.Report(ctx, instrument.EventCall, "name", "cache")
+contexts:
+  - type: "*github.com/acme/web.Context"
+    get: $param.Context()
+    set: $param.SetContext($ctx)
+`), 0644)
+	require.NoError(t, err)
+
+	f, err := Load(name)
+	require.NoError(t, err)
+	require.Equal(t, []Rule{
+		{
+			Name:   "redis",
+			Match:  Match{Package: "github.com/redis/go-redis/v9", Function: "NewClient"},
+			Action: Action{Kind: WrapArgument, Package: "github.com/acme/tracing", Function: "WrapOptions"},
+		},
+		{
+			Name:  "cache",
+			Match: Match{Package: "github.com/acme/cache", Type: "Cache", Function: "Get"},
+			Action: Action{
+				Kind:       PrependStatements,
+				Package:    RuntimePackage,
+				Statements: []string{`instrument.Report(ctx, instrument.EventCall, "name", "cache")`},
+			},
+		},
+	}, f.Rules)
+	require.Equal(t, []Context{
+		{Type: "*github.com/acme/web.Context", Get: "$param.Context()", Set: "$param.SetContext($ctx)"},
+	}, f.Contexts)
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		rule Rule
+	}{
+		{name: "no package", rule: Rule{Match: Match{Function: "F"}, Action: Action{Kind: ReplaceFunction, Function: "G"}}},
+		{name: "no function or type", rule: Rule{Match: Match{Package: "p"}, Action: Action{Kind: ReplaceFunction, Function: "G"}}},
+		{name: "unknown kind", rule: Rule{Match: Match{Package: "p", Function: "F"}, Action: Action{Kind: "explode"}}},
+		{name: "invalid mode", rule: Rule{Mode: "both", Match: Match{Package: "p", Function: "F"}, Action: Action{Kind: ReplaceFunction, Function: "G"}}},
+		{name: "replace method", rule: Rule{Match: Match{Package: "p", Type: "T", Function: "F"}, Action: Action{Kind: ReplaceFunction, Function: "G"}}},
+		{name: "pass wrapped argument", rule: Rule{Match: Match{Package: "p", Function: "F"}, Action: Action{Kind: WrapArgument, Function: "G", Argument: 1, Arguments: []int{1}}}},
+		{name: "pass argument of assignment", rule: Rule{Match: Match{Package: "p", Type: "T"}, Action: Action{Kind: WrapArgument, Function: "G", Arguments: []int{1}}}},
+		{name: "append to assignment", rule: Rule{Match: Match{Package: "p", Type: "T"}, Action: Action{Kind: AppendArguments, Functions: []string{"G"}}}},
+		{name: "wrap result without function", rule: Rule{Match: Match{Package: "p", Function: "F"}, Action: Action{Kind: WrapResult}}},
+		{name: "wrap result of assignment", rule: Rule{Match: Match{Package: "p", Type: "T"}, Action: Action{Kind: WrapResult, Function: "G"}}},
+		{name: "field without type", rule: Rule{Match: Match{Package: "p", Function: "F", Field: "H"}, Action: Action{Kind: WrapArgument, Function: "G"}}},
+		{name: "field of method", rule: Rule{Match: Match{Package: "p", Type: "T", Function: "F", Field: "H"}, Action: Action{Kind: WrapArgument, Function: "G"}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Error(t, tt.rule.Validate())
+		})
+	}
+	for _, r := range Builtin {
+		t.Run(r.Name, func(t *testing.T) {
+			require.NoError(t, r.Validate())
+		})
+	}
+}
+
+func TestValidateContext(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		c    Context
+	}{
+		{name: "no type", c: Context{Get: "$param.Context()", Set: "$param.SetContext($ctx)"}},
+		{name: "get without param", c: Context{Type: "T", Get: "ctx", Set: "$param.SetContext($ctx)"}},
+		{name: "invalid get", c: Context{Type: "T", Get: "$param.Context(", Set: "$param.SetContext($ctx)"}},
+		{name: "set without ctx", c: Context{Type: "T", Get: "$param.Context()", Set: "$param.Reset()"}},
+		{name: "invalid set", c: Context{Type: "T", Get: "$param.Context()", Set: "$param.SetContext($ctx"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Error(t, tt.c.Validate())
+		})
+	}
+	for _, c := range BuiltinContexts {
+		t.Run(c.Type, func(t *testing.T) {
+			require.NoError(t, c.Validate())
+		})
+	}
+}
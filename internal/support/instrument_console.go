@@ -44,7 +44,7 @@ func makeID() string {
 	return uuid.NewString()
 }
 
-func (c ConsoleInstrumenter) WrapHandler(handler http.Handler) http.Handler {
+func (c ConsoleInstrumenter) WrapHandler(handler http.Handler, pattern string) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		// check for incoming trace id and parent span id in request header
@@ -64,10 +64,15 @@ func (c ConsoleInstrumenter) WrapHandler(handler http.Handler) http.Handler {
 		ctx = addFieldToContext(ctx, spanIDField, spanID)
 
 		r = r.WithContext(ctx)
+		// name the span after the route, if any
+		var route string
+		if pattern != "" {
+			route = fmt.Sprintf(", route=%q", routeName(r, pattern))
+		}
 		// print out the values
-		fmt.Fprintf(os.Stderr, "%s: %s server trace_id=%q, parent_span_id=%q, span_id=%q\n", time.Now().UTC().Format(time.RFC3339Nano), event.EventStart, traceID, parentSpanID, spanID)
+		fmt.Fprintf(os.Stderr, "%s: %s server trace_id=%q, parent_span_id=%q, span_id=%q%s\n", time.Now().UTC().Format(time.RFC3339Nano), event.EventStart, traceID, parentSpanID, spanID, route)
 		// defer printing out that we're done
-		defer fmt.Fprintf(os.Stderr, "%s: %s server trace_id=%q, parent_span_id=%q, span_id=%q\n", time.Now().UTC().Format(time.RFC3339Nano), event.EventEnd, traceID, parentSpanID, spanID)
+		defer fmt.Fprintf(os.Stderr, "%s: %s server trace_id=%q, parent_span_id=%q, span_id=%q%s\n", time.Now().UTC().Format(time.RFC3339Nano), event.EventEnd, traceID, parentSpanID, spanID, route)
 		handler.ServeHTTP(rw, r)
 	})
 }
@@ -126,12 +131,12 @@ func (c ConsoleInstrumenter) WrapHTTPClient(client *http.Client) *http.Client {
 	}
 }
 
-func (c ConsoleInstrumenter) WrapHandlerFunc(handlerFunc http.HandlerFunc) http.HandlerFunc {
+func (c ConsoleInstrumenter) WrapHandlerFunc(handlerFunc http.HandlerFunc, pattern string) http.HandlerFunc {
 	// I know it's a HandlerFunc
-	return c.WrapHandler(handlerFunc).(http.HandlerFunc)
+	return c.WrapHandler(handlerFunc, pattern).(http.HandlerFunc)
 }
 
-func (c ConsoleInstrumenter) Init() func() {
+func (c ConsoleInstrumenter) Init(_ string) func() {
 	return func() {}
 }
 
@@ -150,6 +155,13 @@ func (c ConsoleInstrumenter) Report(ctx context.Context, e event.Event, metadata
 	// print out the values
 	fmt.Fprintf(os.Stderr, "%s: %s report trace_id=%q, parent_span_id=%q, span_id=%q", time.Now().UTC().Format(time.RFC3339Nano), e, traceID, parentSpanID, spanID)
 	for i := 0; i < len(metadata); i += 2 {
+		if k, ok := metadata[i].(string); ok && k == "error" {
+			// only failed calls are marked
+			if err := getError(metadata...); err != nil {
+				fmt.Fprintf(os.Stderr, " error=%q", err.Error())
+			}
+			continue
+		}
 		fmt.Fprintf(os.Stderr, " %v=%v", metadata[i], metadata[i+1])
 	}
 	fmt.Fprintln(os.Stderr)
@@ -16,22 +16,39 @@ import (
 
 type DDInstrumenter struct{}
 
-func (_ DDInstrumenter) WrapHandler(handler http.Handler) http.Handler {
-	return httptrace.WrapHandler(handler, "", "")
+func (_ DDInstrumenter) WrapHandler(handler http.Handler, pattern string) http.Handler {
+	if pattern == "" {
+		return httptrace.WrapHandler(handler, "", "")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httptrace.TraceAndServe(handler, w, r, serveConfig(r, pattern))
+	})
 }
 
 func (_ DDInstrumenter) WrapHTTPClient(client *http.Client) *http.Client {
 	return httptrace.WrapClient(client)
 }
 
-func (_ DDInstrumenter) WrapHandlerFunc(handlerFunc http.HandlerFunc) http.HandlerFunc {
+func (_ DDInstrumenter) WrapHandlerFunc(handlerFunc http.HandlerFunc, pattern string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		httptrace.TraceAndServe(handlerFunc, w, r, &httptrace.ServeConfig{})
+		httptrace.TraceAndServe(handlerFunc, w, r, serveConfig(r, pattern))
 	}
 }
 
-func (_ DDInstrumenter) Init() func() {
-	tracer.Start()
+// serveConfig names the span of the request r after the route pattern, if any.
+func serveConfig(r *http.Request, pattern string) *httptrace.ServeConfig {
+	if pattern == "" {
+		return &httptrace.ServeConfig{}
+	}
+	return &httptrace.ServeConfig{Resource: routeName(r, pattern), Route: routePath(pattern)}
+}
+
+func (_ DDInstrumenter) Init(service string) func() {
+	var opts []tracer.StartOption
+	if service != "" {
+		opts = append(opts, tracer.WithService(service))
+	}
+	tracer.Start(opts...)
 	return tracer.Stop
 }
 
@@ -65,7 +82,7 @@ func (_ DDInstrumenter) Report(ctx context.Context, e event.Event, metadata ...a
 			fmt.Printf("Error: Received end/return event but have no corresponding span in the context.\n")
 			return ctx
 		}
-		span.Finish()
+		span.Finish(tracer.WithError(getError(metadata...)))
 	}
 	return ctx
 }
@@ -96,3 +113,15 @@ func getOpName(metadata ...any) string {
 	}
 	return opname
 }
+
+// getError returns the error reported under the "error" key of the metadata, if any.
+func getError(metadata ...any) error {
+	for i := 0; i+1 < len(metadata); i += 2 {
+		if k, ok := metadata[i].(string); ok && k == "error" {
+			if err, ok := metadata[i+1].(error); ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -5,7 +5,10 @@
 
 package support
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestGetOpName(t *testing.T) {
 	for _, tt := range []struct {
@@ -38,3 +41,32 @@ func TestGetOpName(t *testing.T) {
 		})
 	}
 }
+
+func TestGetError(t *testing.T) {
+	boom := errors.New("boom")
+	for _, tt := range []struct {
+		name     string
+		metadata []any
+		err      error
+	}{
+		{
+			name:     "no error",
+			metadata: []any{"function-name", "doThing"},
+		},
+		{
+			name:     "nil error",
+			metadata: []any{"function-name", "doThing", "error", nil},
+		},
+		{
+			name:     "error",
+			metadata: []any{"function-name", "doThing", "error", boom},
+			err:      boom,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := getError(tt.metadata...); err != tt.err {
+				t.Errorf("Expected %v, but got %v\n", tt.err, err)
+			}
+		})
+	}
+}
@@ -7,11 +7,13 @@ package support
 
 import (
 	"context"
+	"fmt"
 	"github.com/jonbodner/orchestrion/instrument/event"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/contrib/propagators/autoprop"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/exporters/jaeger"
 	"go.opentelemetry.io/otel/sdk/resource"
 	tracesdk "go.opentelemetry.io/otel/sdk/trace"
@@ -27,8 +29,8 @@ type OTelInstrumenter struct {
 	RootSpan trace.Span
 }
 
-func (o *OTelInstrumenter) WrapHandler(handler http.Handler) http.Handler {
-	return otelhttp.NewHandler(handler, "")
+func (o *OTelInstrumenter) WrapHandler(handler http.Handler, pattern string) http.Handler {
+	return otelhttp.NewHandler(handler, "", routeOptions(pattern)...)
 }
 
 func (o *OTelInstrumenter) WrapHTTPClient(client *http.Client) *http.Client {
@@ -39,15 +41,30 @@ func (o *OTelInstrumenter) WrapHTTPClient(client *http.Client) *http.Client {
 	return client
 }
 
-func (o *OTelInstrumenter) WrapHandlerFunc(handlerFunc http.HandlerFunc) http.HandlerFunc {
+func (o *OTelInstrumenter) WrapHandlerFunc(handlerFunc http.HandlerFunc, pattern string) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		otelhttp.NewHandler(handlerFunc, "").ServeHTTP(rw, r)
+		otelhttp.NewHandler(handlerFunc, "", routeOptions(pattern)...).ServeHTTP(rw, r)
 	}
 }
 
-func (o *OTelInstrumenter) Init() func() {
+// routeOptions names the spans of the requests after the route pattern, if any.
+func routeOptions(pattern string) []otelhttp.Option {
+	if pattern == "" {
+		return nil
+	}
+	return []otelhttp.Option{
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return routeName(r, pattern)
+		}),
+		otelhttp.WithSpanOptions(trace.WithAttributes(semconv.HTTPRoute(routePath(pattern)))),
+	}
+}
 
-	tp, err := tracerProvider("http://localhost:14268/api/traces")
+func (o *OTelInstrumenter) Init(service string) func() {
+	if service == "" {
+		service = os.Args[0]
+	}
+	tp, err := tracerProvider("http://localhost:14268/api/traces", service)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -70,7 +87,7 @@ func (o *OTelInstrumenter) Init() func() {
 // the Jaeger exporter that will send spans to the provided url. The returned
 // TracerProvider will also use a Resource configured with all the information
 // about the application.
-func tracerProvider(url string) (*tracesdk.TracerProvider, error) {
+func tracerProvider(url string, service string) (*tracesdk.TracerProvider, error) {
 	// Create the Jaeger exporter
 	exp, err := jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(url)))
 	if err != nil {
@@ -82,7 +99,7 @@ func tracerProvider(url string) (*tracesdk.TracerProvider, error) {
 		// Record information about this application in a Resource.
 		tracesdk.WithResource(resource.NewWithAttributes(
 			semconv.SchemaURL,
-			semconv.ServiceName(os.Args[0]),
+			semconv.ServiceName(service),
 			attribute.String("environment", "demo"),
 			attribute.Int64("ID", 1),
 		)),
@@ -100,12 +117,37 @@ func (o *OTelInstrumenter) Report(ctx context.Context, e event.Event, metadata .
 	switch e {
 	case event.EventStart:
 		ctx, span = o.Tracer.Start(ctx, metadata[1].(string))
-		for i := 0; i < len(metadata); i += 2 {
-			span.SetAttributes(attribute.String(metadata[i].(string), metadata[i+1].(string)))
+		for i := 0; i+1 < len(metadata); i += 2 {
+			if k, ok := metadata[i].(string); ok {
+				span.SetAttributes(otelAttribute(k, metadata[i+1]))
+			}
 		}
 	case event.EventEnd:
 		span = trace.SpanFromContext(ctx)
+		if err := getError(metadata...); err != nil {
+			span.RecordError(err, trace.WithStackTrace(true))
+			span.SetStatus(codes.Error, err.Error())
+		}
 		defer span.End()
 	}
 	return ctx
 }
+
+// otelAttribute converts a metadata value to an attribute of its type.
+// The values of other types are formatted as strings.
+func otelAttribute(k string, v any) attribute.KeyValue {
+	switch v := v.(type) {
+	case string:
+		return attribute.String(k, v)
+	case bool:
+		return attribute.Bool(k, v)
+	case int:
+		return attribute.Int(k, v)
+	case int64:
+		return attribute.Int64(k, v)
+	case float64:
+		return attribute.Float64(k, v)
+	default:
+		return attribute.String(k, fmt.Sprint(v))
+	}
+}
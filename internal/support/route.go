@@ -0,0 +1,30 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package support
+
+import (
+	"net/http"
+	"strings"
+)
+
+// routePath returns the path of a http.ServeMux pattern, without its method and host,
+// e.g. /users/{id} for "GET example.com/users/{id}".
+func routePath(pattern string) string {
+	pattern = strings.TrimSpace(pattern)
+	if method, rest, ok := strings.Cut(pattern, " "); ok && !strings.Contains(method, "/") {
+		pattern = strings.TrimSpace(rest)
+	}
+	if i := strings.Index(pattern, "/"); i > 0 {
+		pattern = pattern[i:]
+	}
+	return pattern
+}
+
+// routeName returns the name of the requests served by the route pattern,
+// e.g. "GET /users/{id}".
+func routeName(r *http.Request, pattern string) string {
+	return r.Method + " " + routePath(pattern)
+}
@@ -0,0 +1,34 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package support
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteName(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		path    string
+		name    string
+	}{
+		{pattern: "/users/", path: "/users/", name: "GET /users/"},
+		{pattern: "GET /users/{id}", path: "/users/{id}", name: "GET /users/{id}"},
+		{pattern: "POST  example.com/users/{id...}", path: "/users/{id...}", name: "GET /users/{id...}"},
+		{pattern: "example.com/", path: "/", name: "GET /"},
+	} {
+		t.Run(tt.pattern, func(t *testing.T) {
+			if path := routePath(tt.pattern); path != tt.path {
+				t.Errorf("Expected %s, but got %s\n", tt.path, path)
+			}
+			r := httptest.NewRequest("GET", "/users/1", nil)
+			if name := routeName(r, tt.pattern); name != tt.name {
+				t.Errorf("Expected %s, but got %s\n", tt.name, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package toolexec
+
+import (
+	"go/build"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/jonbodner/orchestrion/internal/config"
+	"github.com/jonbodner/orchestrion/internal/rules"
+)
+
+// Std selects the packages of the standard library in Options.Dependencies.
+const Std = "std"
+
+// inModule reports whether the package pkgPath belongs to the module path.
+func inModule(pkgPath, module string) bool {
+	return pkgPath == module || strings.HasPrefix(pkgPath, module+"/")
+}
+
+// isDependency reports whether the package pkgPath, whose sources are in dir, belongs to one
+// of the dependencies instrumented along with the main module.
+func isDependency(pkgPath, dir string, deps []string) bool {
+	for _, module := range deps {
+		if module == Std {
+			if inStd(dir) {
+				return true
+			}
+			continue
+		}
+		if inModule(pkgPath, module) {
+			return true
+		}
+	}
+	return false
+}
+
+// inStd reports whether the package whose sources are in dir belongs to the standard library,
+// i.e. dir is in $GOROOT/src, outside of the commands in $GOROOT/src/cmd. The import paths
+// can't tell: the paths of the modules don't need a dot, e.g. "server" or "example/app".
+func inStd(dir string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	src := filepath.Join(goroot(), "src")
+	return strings.HasPrefix(dir, src+string(filepath.Separator)) &&
+		dir != filepath.Join(src, "cmd") &&
+		!strings.HasPrefix(dir, filepath.Join(src, "cmd")+string(filepath.Separator))
+}
+
+// goroot returns the GOROOT of the go command. The go command sets it in the
+// environment of the tools it runs; otherwise the GOROOT orchestrion was built with is used.
+func goroot() string {
+	if root := os.Getenv("GOROOT"); root != "" {
+		return root
+	}
+	return runtime.GOROOT()
+}
+
+// goModCache returns the module cache of the go command: $GOMODCACHE, which defaults
+// to pkg/mod in the first directory of $GOPATH.
+func goModCache() string {
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir
+	}
+	gopath := filepath.SplitList(build.Default.GOPATH)
+	if len(gopath) == 0 {
+		return ""
+	}
+	return filepath.Join(gopath[0], "pkg", "mod")
+}
+
+// runtimeDeps returns the packages the instrumented code depends on: the orchestrion
+// runtime, the packages used by the rules of conf, and their dependencies.
+// Instrumenting them would create import cycles. The packages are built with flags.
+func runtimeDeps(work string, conf config.Config, flags []string) (map[string]bool, error) {
+	exports, err := resolveExports(work, []string{rules.RuntimePackage}, flags)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]bool, len(exports))
+	for path := range exports {
+		out[path] = true
+	}
+	for _, r := range conf.Rules {
+		pkgs := []string{r.Action.Package}
+		for _, path := range r.Action.Imports {
+			pkgs = append(pkgs, path)
+		}
+		for _, pkg := range pkgs {
+			if out[pkg] {
+				continue
+			}
+			exports, err := resolveExports(work, []string{pkg}, flags)
+			if err != nil {
+				log.Printf("rule %q: %v", r.Name, err)
+				continue
+			}
+			for path := range exports {
+				out[path] = true
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,39 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package toolexec
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsDependency(t *testing.T) {
+	root := goroot()
+	deps := []string{"example.com/shared", Std}
+	var tests = []struct {
+		pkgPath string
+		dir     string
+		want    bool
+	}{
+		{pkgPath: "example.com/shared", dir: "/src/shared", want: true},
+		{pkgPath: "example.com/shared/db", dir: "/src/shared/db", want: true},
+		{pkgPath: "example.com/sharedlib", dir: "/src/sharedlib", want: false},
+		{pkgPath: "net/http", dir: filepath.Join(root, "src", "net", "http"), want: true},
+		{pkgPath: "fmt", dir: filepath.Join(root, "src", "fmt"), want: true},
+		{pkgPath: "cmd/go", dir: filepath.Join(root, "src", "cmd", "go"), want: false},
+		{pkgPath: "github.com/other/lib", dir: "/src/lib", want: false},
+		// the paths of the modules don't need a dot
+		{pkgPath: "server", dir: "/src/server", want: false},
+		{pkgPath: "example/app/api", dir: "/src/app/api", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pkgPath, func(t *testing.T) {
+			require.Equal(t, tt.want, isDependency(tt.pkgPath, tt.dir, deps))
+		})
+	}
+}
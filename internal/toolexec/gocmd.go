@@ -0,0 +1,221 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package toolexec
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// buildCommands are the go commands accepting the -toolexec flag.
+var buildCommands = map[string]bool{
+	"build":   true,
+	"install": true,
+	"run":     true,
+	"test":    true,
+	"vet":     true,
+}
+
+// Go runs the go command with args, e.g. "build ./...". Build commands run orchestrion -t
+// with flags as their -toolexec, so the packages of the current module are compiled
+// instrumented. Other commands are run unchanged.
+func Go(args []string, flags []string, opts Options) error {
+	if len(args) == 0 {
+		return errors.New("missing go command")
+	}
+	if !opts.Verbose {
+		log.SetOutput(io.Discard)
+	}
+	goArgs := args
+	if buildCommands[args[0]] {
+		if _, ok := flagValue(args, "-toolexec"); ok {
+			return errors.New("-toolexec is set by orchestrion")
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		if opts.Module == "" {
+			opts.Module = currentModule()
+		}
+		goArgs = goCommandArgs(args, exe, flags, opts)
+	}
+	log.Printf("running go %s", strings.Join(goArgs, " "))
+	cmd := exec.Command("go", goArgs...)
+	if buildCommands[args[0]] {
+		flags, err := json.Marshal(buildFlags(args))
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(os.Environ(), buildFlagsEnv+"="+string(flags))
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// buildFlagsEnv holds the build flags of the go command run by Go, as a JSON list,
+// for orchestrion -t. See buildFlags.
+const buildFlagsEnv = "ORCHESTRION_BUILDFLAGS"
+
+// exportFlags are the go build flags changing the export data of the packages, and
+// whether they take a value.
+var exportFlags = map[string]bool{
+	"-asan":          false,
+	"-asmflags":      true,
+	"-buildmode":     true,
+	"-cover":         false,
+	"-covermode":     true,
+	"-coverpkg":      true,
+	"-gcflags":       true,
+	"-installsuffix": true,
+	"-mod":           true,
+	"-modfile":       true,
+	"-msan":          false,
+	"-overlay":       true,
+	"-pgo":           true,
+	"-race":          false,
+	"-tags":          true,
+	"-trimpath":      false,
+}
+
+// valueFlags are the other flags of the build commands taking a value.
+var valueFlags = map[string]bool{
+	"-bench":        true,
+	"-benchtime":    true,
+	"-blockprofile": true,
+	"-compiler":     true,
+	"-count":        true,
+	"-coverprofile": true,
+	"-cpu":          true,
+	"-cpuprofile":   true,
+	"-exec":         true,
+	"-gccgoflags":   true,
+	"-ldflags":      true,
+	"-memprofile":   true,
+	"-mutexprofile": true,
+	"-o":            true,
+	"-outputdir":    true,
+	"-p":            true,
+	"-parallel":     true,
+	"-pkgdir":       true,
+	"-run":          true,
+	"-shuffle":      true,
+	"-skip":         true,
+	"-timeout":      true,
+	"-toolexec":     true,
+	"-trace":        true,
+	"-vet":          true,
+}
+
+// buildFlags returns the flags of the build command args changing the export data of the
+// packages, as -name or -name=value. They are read up to the first argument that isn't a flag.
+func buildFlags(args []string) []string {
+	var out []string
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		if strings.HasPrefix(arg, "--") {
+			arg = arg[1:]
+		}
+		name, _, hasValue := strings.Cut(arg, "=")
+		takesValue, export := exportFlags[name]
+		if !export {
+			takesValue = valueFlags[name]
+		}
+		if takesValue && !hasValue && i+1 < len(args) {
+			i++
+			arg += "=" + args[i]
+		}
+		if export {
+			out = append(out, arg)
+		}
+	}
+	return out
+}
+
+// parentBuildFlags returns the build flags of the go command running the tool with args:
+// those forwarded by Go, and the ones found in args, e.g. -race.
+func parentBuildFlags(args []string) []string {
+	var out []string
+	if v := os.Getenv(buildFlagsEnv); v != "" {
+		if err := json.Unmarshal([]byte(v), &out); err != nil {
+			log.Printf("ignoring %s: %v", buildFlagsEnv, err)
+			out = nil
+		}
+	}
+	seen := make(map[string]bool, len(out))
+	for _, f := range out {
+		seen[f] = true
+	}
+	for _, arg := range args {
+		switch arg {
+		case "-race", "-msan", "-asan":
+			if !seen[arg] {
+				seen[arg] = true
+				out = append(out, arg)
+			}
+		}
+	}
+	return out
+}
+
+// goCommandArgs inserts the -toolexec flag running exe in the build command args.
+func goCommandArgs(args []string, exe string, flags []string, opts Options) []string {
+	toolexec := append([]string{exe, "-t"}, flags...)
+	if opts.Module != "" {
+		toolexec = append(toolexec, "-module", opts.Module)
+	}
+	if len(opts.Dependencies) > 0 {
+		toolexec = append(toolexec, "-deps", strings.Join(opts.Dependencies, ","))
+	}
+	if opts.Verbose {
+		toolexec = append(toolexec, "-v")
+	}
+	out := []string{args[0], "-toolexec", quoteFields(toolexec)}
+	return append(out, args[1:]...)
+}
+
+// quoteFields joins fields in a string the go command splits back into them.
+// It understands single and double quotes, without escapes.
+func quoteFields(fields []string) string {
+	quoted := make([]string, len(fields))
+	for i, f := range fields {
+		switch {
+		case f != "" && !strings.ContainsAny(f, " \t\n\r'\""):
+			quoted[i] = f
+		case !strings.Contains(f, "'"):
+			quoted[i] = "'" + f + "'"
+		default:
+			quoted[i] = `"` + f + `"`
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// currentModule returns the path of the module in the current directory, if there is exactly one.
+func currentModule() string {
+	cmd := exec.Command("go", "list", "-m", "-f", "{{.Path}}")
+	cmd.Env = goEnv()
+	out, err := cmd.Output()
+	if err != nil {
+		log.Printf("no module found, instrumenting the packages outside of GOROOT and of the module cache: %v", err)
+		return ""
+	}
+	paths := strings.Fields(string(out))
+	if len(paths) != 1 {
+		return ""
+	}
+	return paths[0]
+}
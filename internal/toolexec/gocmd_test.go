@@ -0,0 +1,41 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package toolexec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoCommandArgs(t *testing.T) {
+	got := goCommandArgs([]string{"test", "-count=1", "./..."}, "/usr/bin/orchestrion", []string{"-httpmode", "report"}, Options{Module: "example.com/pkg"})
+	require.Equal(t, []string{"test", "-toolexec", "/usr/bin/orchestrion -t -httpmode report -module example.com/pkg", "-count=1", "./..."}, got)
+}
+
+func TestQuoteFields(t *testing.T) {
+	var tests = []struct {
+		fields []string
+		want   string
+	}{
+		{fields: []string{"/bin/orchestrion", "-t"}, want: "/bin/orchestrion -t"},
+		{fields: []string{"/my programs/orchestrion", "-t"}, want: "'/my programs/orchestrion' -t"},
+		{fields: []string{"it's", ""}, want: `"it's" ''`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			require.Equal(t, tt.want, quoteFields(tt.fields))
+		})
+	}
+}
+
+func TestBuildFlags(t *testing.T) {
+	args := []string{"test", "-count", "1", "--race", "-tags", "integration", "-v", "-gcflags=all=-N -l", "-o", "out", "./...", "-cover"}
+	require.Equal(t, []string{"-race", "-tags=integration", "-gcflags=all=-N -l"}, buildFlags(args))
+
+	t.Setenv(buildFlagsEnv, `["-race","-tags=integration"]`)
+	require.Equal(t, []string{"-race", "-tags=integration", "-msan"}, parentBuildFlags([]string{"-p", "main", "-race", "-msan", "main.go"}))
+}
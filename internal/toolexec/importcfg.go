@@ -0,0 +1,329 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package toolexec
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jonbodner/orchestrion/internal/rules"
+)
+
+// The instrumented code imports packages the original code may not depend on,
+// starting with the orchestrion runtime. The go command only lists the
+// dependencies of the original code in the importcfg files it passes to the
+// compiler and the linker, so the missing packages are built with "go list -export"
+// and added to them.
+//
+// The packages added for a compilation are recorded in the $WORK directory of the
+// build, and added to the importcfg of the linker along with the runtime.
+//
+// They are built with the flags of the build changing the export data, e.g. -race or
+// -tags (see parentBuildFlags), and GOFLAGS: otherwise they wouldn't match the
+// packages built by the go command, and the compilation or the link would fail.
+
+// readImportcfg returns the export data files listed in an importcfg file, keyed by import path.
+func readImportcfg(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading importcfg: %w", err)
+	}
+	defer f.Close()
+	exports := make(map[string]string)
+	importmap := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		verb, args, _ := strings.Cut(strings.TrimSpace(s.Text()), " ")
+		key, value, ok := strings.Cut(args, "=")
+		if !ok {
+			continue
+		}
+		switch verb {
+		case "packagefile":
+			exports[key] = value
+		case "importmap":
+			importmap[key] = value
+		}
+	}
+	for path, actual := range importmap {
+		if file, ok := exports[actual]; ok {
+			exports[path] = file
+		}
+	}
+	return exports, s.Err()
+}
+
+// writeImportcfg writes a copy of the importcfg file orig to name, with the packages of extra it doesn't list.
+func writeImportcfg(name, orig string, exports, extra map[string]string) error {
+	b, err := os.ReadFile(orig)
+	if err != nil {
+		return fmt.Errorf("error reading importcfg: %w", err)
+	}
+	out := bytes.NewBuffer(b)
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		out.WriteByte('\n')
+	}
+	for _, path := range sortedKeys(extra) {
+		if _, ok := exports[path]; !ok {
+			fmt.Fprintf(out, "packagefile %s=%s\n", path, extra[path])
+		}
+	}
+	return os.WriteFile(name, out.Bytes(), 0644)
+}
+
+// missingImports returns the packages imported by files that are not in exports.
+func missingImports(files []string, exports map[string]string) ([]string, error) {
+	seen := make(map[string]bool)
+	var out []string
+	fset := token.NewFileSet()
+	for _, name := range files {
+		f, err := parser.ParseFile(fset, name, nil, parser.ImportsOnly)
+		if err != nil {
+			return nil, err
+		}
+		for _, imp := range f.Imports {
+			path, err := strconv.Unquote(imp.Path.Value)
+			if err != nil || path == "C" || path == "unsafe" || seen[path] {
+				continue
+			}
+			seen[path] = true
+			if _, ok := exports[path]; !ok {
+				out = append(out, path)
+			}
+		}
+	}
+	return out, nil
+}
+
+// injectCompile adds the packages imported by the instrumented files and missing from the
+// importcfg of the compiler to a copy of it, written in tmpDir. It returns the updated arguments.
+// The packages are built with flags.
+func injectCompile(tmpDir string, args, files, flags []string) ([]string, error) {
+	importcfg, ok := flagValue(args, "-importcfg")
+	if !ok {
+		return args, nil
+	}
+	exports, err := readImportcfg(importcfg)
+	if err != nil {
+		return nil, err
+	}
+	missing, err := missingImports(files, exports)
+	if err != nil || len(missing) == 0 {
+		return args, err
+	}
+	log.Printf("adding %v to %s", missing, importcfg)
+	extra, err := resolveExports(workDir(importcfg), missing, flags)
+	if err != nil {
+		return nil, err
+	}
+	return replaceImportcfg(tmpDir, args, importcfg, exports, extra)
+}
+
+// injectLink adds the orchestrion runtime, and the packages added to the compilations of
+// the build, to a copy of the importcfg of the linker written in tmpDir. It returns the updated arguments.
+// Programs that don't use the runtime still link, so failing to build it is not an error.
+// The runtime is built with flags.
+func injectLink(tmpDir string, args, flags []string) ([]string, error) {
+	importcfg, ok := flagValue(args, "-importcfg")
+	if !ok {
+		return args, nil
+	}
+	exports, err := readImportcfg(importcfg)
+	if err != nil {
+		return nil, err
+	}
+	work := workDir(importcfg)
+	if _, ok := exports[rules.RuntimePackage]; !ok {
+		if _, err := resolveExports(work, []string{rules.RuntimePackage}, flags); err != nil {
+			log.Printf("orchestrion runtime unavailable: %v", err)
+		}
+	}
+	extra, err := recordedExports(work)
+	if err != nil {
+		return nil, err
+	}
+	return replaceImportcfg(tmpDir, args, importcfg, exports, extra)
+}
+
+func replaceImportcfg(tmpDir string, args []string, importcfg string, exports, extra map[string]string) ([]string, error) {
+	name := filepath.Join(tmpDir, filepath.Base(importcfg))
+	if err := writeImportcfg(name, importcfg, exports, extra); err != nil {
+		return nil, err
+	}
+	out := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case arg == importcfg && i > 0 && args[i-1] == "-importcfg":
+			out[i] = name
+		case arg == "-importcfg="+importcfg:
+			out[i] = "-importcfg=" + name
+		default:
+			out[i] = arg
+		}
+	}
+	return out, nil
+}
+
+// workDir returns the $WORK directory of the build, from the name of an importcfg file in it.
+func workDir(importcfg string) string {
+	return filepath.Dir(filepath.Dir(importcfg))
+}
+
+// cacheDir is where the packages added to the importcfg files of a build are recorded.
+func cacheDir(work string) string {
+	return filepath.Join(work, "orchestrion")
+}
+
+// resolveExports returns the export data files of pkgs and of their dependencies, built with flags.
+// The result is recorded in the $WORK directory, so that each set of packages is only built once
+// with the same flags.
+func resolveExports(work string, pkgs, flags []string) (map[string]string, error) {
+	sort.Strings(pkgs)
+	name := filepath.Join(cacheDir(work), exportsKey(pkgs, flags)+".importcfg")
+	if _, err := os.Stat(name); err == nil {
+		return readImportcfg(name)
+	}
+
+	out, err := listExports(".", pkgs, flags)
+	if err != nil {
+		out, err = listExportsFromRuntime(pkgs, flags, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(cacheDir(work), 0755); err != nil {
+		return nil, err
+	}
+	// Concurrent compilations may resolve the same packages: write the file atomically.
+	f, err := os.CreateTemp(cacheDir(work), "tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(out)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return readImportcfg(name)
+}
+
+// recordedExports returns all the packages recorded in the $WORK directory.
+func recordedExports(work string) (map[string]string, error) {
+	names, err := filepath.Glob(filepath.Join(cacheDir(work), "*.importcfg"))
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string)
+	for _, name := range names {
+		exports, err := readImportcfg(name)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range exports {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+// exportsKey identifies the export data files of pkgs built with flags, and GOFLAGS.
+func exportsKey(pkgs, flags []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(pkgs, "\n") + "\x00" + strings.Join(flags, "\n") + "\x00" + os.Getenv("GOFLAGS")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// listExports runs "go list -export" in dir with flags, and returns the export data files of
+// pkgs and of their dependencies in the importcfg format.
+func listExports(dir string, pkgs, flags []string) ([]byte, error) {
+	args := append([]string{"list"}, flags...)
+	args = append(args, "-deps", "-export", "-f", "{{if .Export}}packagefile {{.ImportPath}}={{.Export}}{{end}}")
+	args = append(args, pkgs...)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = goEnv()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list %s: %w: %s", strings.Join(pkgs, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// listExportsFromRuntime lists the export data files of pkgs in a temporary module requiring
+// the version of orchestrion currently running. It is used when the module being built
+// doesn't require orchestrion. Only the packages of orchestrion and of its dependencies can be found.
+func listExportsFromRuntime(pkgs, flags []string, cause error) ([]byte, error) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return nil, fmt.Errorf("%w (add %s to the module requirements)", cause, orchestrionModule)
+	}
+	dir, err := os.MkdirTemp("", "orchestrion-runtime")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	gomod := fmt.Sprintf("module orchestrion-runtime\n\nrequire %s %s\n", info.Main.Path, info.Main.Version)
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(gomod), 0644); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("go", "get", info.Main.Path+"@"+info.Main.Version)
+	cmd.Dir = dir
+	cmd.Env = goEnv()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return listExports(dir, pkgs, flags)
+}
+
+// goEnv returns the environment of the go commands run by orchestrion.
+// The -toolexec flag is removed from GOFLAGS, so that orchestrion doesn't run itself.
+func goEnv() []string {
+	env := os.Environ()
+	for i, v := range env {
+		flags, ok := strings.CutPrefix(v, "GOFLAGS=")
+		if !ok {
+			continue
+		}
+		var kept []string
+		for _, f := range strings.Fields(flags) {
+			if !strings.HasPrefix(f, "-toolexec") && !strings.HasPrefix(f, "--toolexec") {
+				kept = append(kept, f)
+			}
+		}
+		env[i] = "GOFLAGS=" + strings.Join(kept, " ")
+	}
+	return env
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
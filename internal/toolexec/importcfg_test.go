@@ -0,0 +1,114 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package toolexec
+
+import (
+	"go/types"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jonbodner/orchestrion/internal/typechecker"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadImportcfg(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "importcfg")
+	cfg := `# import config
+packagefile fmt=/cache/fmt.a
+packagefile example.com/vendored/lib=/cache/lib.a
+importmap lib=example.com/vendored/lib
+`
+	require.NoError(t, os.WriteFile(name, []byte(cfg), 0644))
+
+	exports, err := readImportcfg(name)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"fmt":                      "/cache/fmt.a",
+		"example.com/vendored/lib": "/cache/lib.a",
+		"lib":                      "/cache/lib.a",
+	}, exports)
+}
+
+func TestReplaceImportcfg(t *testing.T) {
+	work := t.TempDir()
+	importcfg := filepath.Join(work, "b001", "importcfg")
+	require.NoError(t, os.MkdirAll(filepath.Dir(importcfg), 0755))
+	require.NoError(t, os.WriteFile(importcfg, []byte("packagefile fmt=/cache/fmt.a"), 0644))
+	tmpDir := t.TempDir()
+
+	args := []string{"-p", "main", "-importcfg", importcfg, "-pack", "main.go"}
+	exports := map[string]string{"fmt": "/cache/fmt.a"}
+	extra := map[string]string{"fmt": "/other/fmt.a", "github.com/jonbodner/orchestrion/instrument": "/cache/instrument.a"}
+	got, err := replaceImportcfg(tmpDir, args, importcfg, exports, extra)
+	require.NoError(t, err)
+
+	name := filepath.Join(tmpDir, "importcfg")
+	require.Equal(t, []string{"-p", "main", "-importcfg", name, "-pack", "main.go"}, got)
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, "packagefile fmt=/cache/fmt.a\npackagefile github.com/jonbodner/orchestrion/instrument=/cache/instrument.a\n", string(b))
+	require.Equal(t, work, workDir(importcfg))
+}
+
+func TestMissingImports(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "main.go")
+	code := `package main
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/jonbodner/orchestrion/instrument"
+)
+`
+	require.NoError(t, os.WriteFile(name, []byte(code), 0644))
+
+	missing, err := missingImports([]string{name}, map[string]string{"fmt": "/cache/fmt.a"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"github.com/jonbodner/orchestrion/instrument"}, missing)
+}
+
+func TestGoEnv(t *testing.T) {
+	t.Setenv("GOFLAGS", "-mod=mod -toolexec=orchestrion -tags=integration")
+	require.Contains(t, goEnv(), "GOFLAGS=-mod=mod -tags=integration")
+}
+
+func TestResolveExportsFlags(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":        "module example.com/tagged\n\ngo 1.19\n",
+		"dep/dep.go":    "package dep\n\nconst Plain = 0\n",
+		"dep/tagged.go": "//go:build custom\n\npackage dep\n\nconst Tagged = 1\n",
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+		require.NoError(t, os.WriteFile(name, []byte(content), 0644))
+	}
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+	work := t.TempDir()
+
+	const pkg = "example.com/tagged/dep"
+	lookup := func(flags []string) types.Object {
+		exports, err := resolveExports(work, []string{pkg}, flags)
+		require.NoError(t, err)
+		p, err := typechecker.ExportImporter(exports).Import(pkg)
+		require.NoError(t, err)
+		return p.Scope().Lookup("Tagged")
+	}
+	require.Nil(t, lookup(nil))
+	require.NotNil(t, lookup([]string{"-tags=custom"}))
+	// each set of flags is recorded on its own
+	require.Nil(t, lookup(nil))
+	entries, err := os.ReadDir(cacheDir(work))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
@@ -0,0 +1,315 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+// Package toolexec implements the protocol of "go build -toolexec": orchestrion
+// is invoked with the path of a go tool and its arguments, and runs the tool
+// after instrumenting the sources it compiles.
+package toolexec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jonbodner/orchestrion/internal/config"
+	"github.com/jonbodner/orchestrion/internal/instrument"
+	"github.com/jonbodner/orchestrion/internal/typechecker"
+)
+
+const orchestrionModule = "github.com/jonbodner/orchestrion"
+
+// Options controls how the go tools are run.
+type Options struct {
+	// Module is the path of the module whose packages are instrumented.
+	// When empty, the packages whose sources are outside of GOROOT and of the module cache are instrumented.
+	Module string
+	// Dependencies are the paths of other modules whose packages are instrumented too.
+	// Std selects the standard library. The packages the orchestrion runtime depends on are never instrumented.
+	Dependencies []string
+	// Verbose enables logging to stderr. The toolexec mode is silent otherwise.
+	Verbose bool
+	// BuildFlags are the flags of the go command running the tools that change the export
+	// data of the packages, e.g. -race or -tags. The packages added to the importcfg files
+	// are built with them, so that they match the rest of the build.
+	BuildFlags []string
+}
+
+// Run runs the go tool with args, instrumenting the package sources when the tool is the compiler.
+func Run(tool string, args []string, conf config.Config, opts Options) error {
+	if !opts.Verbose {
+		log.SetOutput(io.Discard)
+	}
+	// The instrumented files are compiled from a temporary directory.
+	conf.LineDirectives = true
+	opts.BuildFlags = append(opts.BuildFlags, parentBuildFlags(args)...)
+	if len(args) > 0 && args[0] == "-V=full" {
+		return printVersion(tool, args, conf, opts)
+	}
+	switch toolName(tool) {
+	case "compile", "link":
+		tmpDir, err := os.MkdirTemp("", "orchestrion")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		if toolName(tool) == "compile" {
+			args, err = instrumentCompile(tmpDir, args, conf, opts)
+		} else {
+			args, err = injectLink(tmpDir, args, opts.BuildFlags)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return run(tool, args, os.Stdout)
+}
+
+func run(tool string, args []string, stdout io.Writer) error {
+	cmd := exec.Command(tool, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// IsTool reports whether arg is the path of a go tool, as passed by "go build -toolexec".
+// Go tools are installed in $GOROOT/pkg/tool/$GOOS_$GOARCH.
+func IsTool(arg string) bool {
+	if !filepath.IsAbs(arg) || filepath.Base(filepath.Dir(filepath.Dir(arg))) != "tool" {
+		return false
+	}
+	switch toolName(arg) {
+	case "addr2line", "asm", "buildid", "cgo", "compile", "covdata", "cover", "doc", "fix", "link", "nm", "objdump", "pack", "pprof", "test2json", "trace", "vet":
+		return true
+	}
+	return false
+}
+
+// toolName returns the name of a go tool from its path, e.g. "compile".
+func toolName(tool string) string {
+	return strings.TrimSuffix(filepath.Base(tool), ".exe")
+}
+
+// flagValue returns the value of the flag name in args, given either as "-name value" or "-name=value".
+func flagValue(args []string, name string) (string, bool) {
+	for i, arg := range args {
+		if arg == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return arg[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// printVersion runs the tool with -V=full and appends an orchestrion specific suffix to its output.
+// The go command uses this output as part of the build cache keys, so that packages are
+// built again when orchestrion or its configuration changes.
+func printVersion(tool string, args []string, conf config.Config, opts Options) error {
+	var out bytes.Buffer
+	if err := run(tool, args, &out); err != nil {
+		return err
+	}
+	suffix, err := versionSuffix(conf, opts)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(appendVersion(strings.TrimSpace(out.String()), suffix))
+	return err
+}
+
+// appendVersion adds suffix to the output of "tool -V=full".
+// Release toolchains print e.g. "compile version go1.21.0", and the whole line is used in cache keys.
+// Development toolchains end the line with a build ID, and only its content ID part is used:
+// it is replaced by a hash of itself and of the suffix.
+func appendVersion(line, suffix string) string {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[2] != "devel" || !strings.HasPrefix(fields[len(fields)-1], "buildID=") {
+		return line + " " + suffix
+	}
+	last := fields[len(fields)-1]
+	i := strings.LastIndex(last, "/")
+	sum := sha256.Sum256([]byte(last[i+1:] + suffix))
+	fields[len(fields)-1] = last[:i+1] + hex.EncodeToString(sum[:])[:32]
+	return strings.Join(append(fields[:len(fields)-1], suffix, fields[len(fields)-1]), " ")
+}
+
+// versionSuffix identifies the orchestrion binary and its configuration.
+func versionSuffix(conf config.Config, opts Options) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	// The configuration is hashed from its JSON encoding, which is deterministic:
+	// printing it would give the addresses of its pointers, e.g. Override.RecordPanics.
+	key, err := json.Marshal(struct {
+		Config       config.Config
+		Module       string
+		Dependencies []string
+	}{conf, opts.Module, opts.Dependencies})
+	if err != nil {
+		return "", err
+	}
+	h.Write(key)
+	return "orchestrion@" + hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// instrumentCompile instruments the sources of the package compiled with args, if it should be.
+// The instrumented sources are written to tmpDir, and the returned arguments refer to them.
+func instrumentCompile(tmpDir string, args []string, conf config.Config, opts Options) ([]string, error) {
+	pkgPath := importPath(args)
+	var files []string
+	for _, v := range args {
+		if strings.HasSuffix(v, ".go") && !strings.HasPrefix(v, "-") {
+			files = append(files, v)
+		}
+	}
+	if len(files) == 0 {
+		return args, nil
+	}
+	dir := filepath.Dir(files[0])
+	ok, err := shouldInstrument(pkgPath, dir, opts)
+	if err != nil || !ok {
+		return args, err
+	}
+	if !conf.Includes(pkgPath) {
+		return args, nil
+	}
+	conf = conf.For(pkgPath)
+	importcfg, hasImportcfg := flagValue(args, "-importcfg")
+	if isDependency(pkgPath, dir, opts.Dependencies) {
+		if !hasImportcfg {
+			return args, nil
+		}
+		excluded, err := runtimeDeps(workDir(importcfg), conf, opts.BuildFlags)
+		if err != nil {
+			log.Printf("not instrumenting dependency %s: %v", pkgPath, err)
+			return args, nil
+		}
+		if excluded[pkgPath] {
+			return args, nil
+		}
+	}
+	log.Printf("instrumenting package %s", pkgPath)
+
+	if hasImportcfg {
+		exports, err := readImportcfg(importcfg)
+		if err != nil {
+			return nil, err
+		}
+		typechecker.Register(&typechecker.Package{Path: pkgPath, Files: absFiles(files), Importer: typechecker.ExportImporter(exports)})
+	}
+
+	var newFiles []string
+	newArgs := make([]string, 0, len(args))
+	for i, v := range args {
+		if !(strings.HasSuffix(v, ".go") && !strings.HasPrefix(v, "-")) {
+			newArgs = append(newArgs, v)
+			continue
+		}
+		newFileName, err := instrumentFile(tmpDir, i, v, conf)
+		if err != nil {
+			return nil, err
+		}
+		newArgs = append(newArgs, newFileName)
+		newFiles = append(newFiles, newFileName)
+	}
+	return injectCompile(tmpDir, newArgs, newFiles, opts.BuildFlags)
+}
+
+// importPath returns the import path of the package compiled with args.
+// The -p flag is "main" for commands, so the path given by the go command is preferred.
+func importPath(args []string) string {
+	if path := os.Getenv("TOOLEXEC_IMPORTPATH"); path != "" {
+		// Test variants are reported as e.g. "example.com/pkg [example.com/pkg.test]".
+		path, _, _ = strings.Cut(path, " ")
+		return path
+	}
+	path, _ := flagValue(args, "-p")
+	return path
+}
+
+func absFiles(files []string) []string {
+	out := make([]string, 0, len(files))
+	for _, f := range files {
+		if abs, err := filepath.Abs(f); err == nil {
+			out = append(out, abs)
+		}
+	}
+	return out
+}
+
+// instrumentFile writes the instrumented version of the file name to tmpDir, and returns its name.
+// The argument index keeps the names of files coming from different directories apart.
+// The generated files, and those excluded by conf, are not instrumented: their name is returned as is.
+func instrumentFile(tmpDir string, index int, name string, conf config.Config) (string, error) {
+	fullName, err := filepath.Abs(name)
+	if err != nil {
+		return "", fmt.Errorf("sanitizing path (%s) failed: %w", name, err)
+	}
+	src, err := os.ReadFile(fullName)
+	if err != nil {
+		return "", fmt.Errorf("error opening file: %w", err)
+	}
+	if !conf.IncludesFile(fullName) || instrument.IsGenerated(fullName, src) {
+		return name, nil
+	}
+	out, err := instrument.InstrumentFile(fullName, bytes.NewReader(src), conf)
+	if err != nil {
+		return "", fmt.Errorf("error scanning file %s: %w", fullName, err)
+	}
+	txt, err := io.ReadAll(out)
+	if err != nil {
+		return "", err
+	}
+	newFileName := filepath.Join(tmpDir, fmt.Sprintf("%d_%s", index, filepath.Base(fullName)))
+	log.Printf("writing %s to %s", fullName, newFileName)
+	return newFileName, os.WriteFile(newFileName, txt, 0644)
+}
+
+// shouldInstrument reports whether the package pkgPath, whose sources are in dir, is instrumented.
+// The orchestrion runtime is never instrumented, the dependencies are.
+func shouldInstrument(pkgPath, dir string, opts Options) (bool, error) {
+	if inModule(pkgPath, orchestrionModule) {
+		return false, nil
+	}
+	if isDependency(pkgPath, dir, opts.Dependencies) {
+		return true, nil
+	}
+	if opts.Module != "" {
+		return inModule(pkgPath, opts.Module), nil
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, root := range []string{goroot(), goModCache()} {
+		if root == "" {
+			continue
+		}
+		if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			return false, nil
+		}
+	}
+	return !strings.Contains(dir, string(filepath.Separator)+"vendor"+string(filepath.Separator)), nil
+}
@@ -0,0 +1,125 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package toolexec
+
+import (
+	"testing"
+
+	"github.com/jonbodner/orchestrion/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendVersion(t *testing.T) {
+	var tests = []struct {
+		line string
+		want string
+	}{
+		{
+			line: "compile version go1.21.0",
+			want: "compile version go1.21.0 orchestrion@1234",
+		},
+		{
+			line: "compile version devel go1.22-abcdef Tue Aug 1 00:00:00 2023 +0000 buildID=action/content",
+			want: "compile version devel go1.22-abcdef Tue Aug 1 00:00:00 2023 +0000 orchestrion@1234 buildID=action/9f319de8b2e12f4b05ae22f0dd57508e",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			require.Equal(t, tt.want, appendVersion(tt.line, "orchestrion@1234"))
+		})
+	}
+}
+
+func TestVersionSuffix(t *testing.T) {
+	newConf := func() config.Config {
+		panics := true
+		return config.Config{
+			HTTPMode:        "wrap",
+			Instrumentation: "dd",
+			Packages:        []config.Override{{Package: "example.com/app/...", RecordPanics: &panics}},
+		}
+	}
+	opts := Options{Module: "example.com/app"}
+	first, err := versionSuffix(newConf(), opts)
+	require.NoError(t, err)
+	second, err := versionSuffix(newConf(), opts)
+	require.NoError(t, err)
+	require.Equal(t, first, second)
+
+	conf := newConf()
+	conf.Instrumentation = "otel"
+	other, err := versionSuffix(conf, opts)
+	require.NoError(t, err)
+	require.NotEqual(t, first, other)
+}
+
+func TestFlagValue(t *testing.T) {
+	args := []string{"-o", "/work/b001/_pkg_.a", "-p", "example.com/pkg", "-importcfg=/work/b001/importcfg", "-pack", "main.go"}
+
+	v, ok := flagValue(args, "-p")
+	require.True(t, ok)
+	require.Equal(t, "example.com/pkg", v)
+
+	v, ok = flagValue(args, "-importcfg")
+	require.True(t, ok)
+	require.Equal(t, "/work/b001/importcfg", v)
+
+	_, ok = flagValue(args, "-lang")
+	require.False(t, ok)
+}
+
+func TestShouldInstrument(t *testing.T) {
+	var tests = []struct {
+		pkgPath string
+		module  string
+		want    bool
+	}{
+		{pkgPath: "example.com/pkg", module: "example.com/pkg", want: true},
+		{pkgPath: "example.com/pkg/sub", module: "example.com/pkg", want: true},
+		{pkgPath: "example.com/pkgs", module: "example.com/pkg", want: false},
+		{pkgPath: "net/http", module: "example.com/pkg", want: false},
+		{pkgPath: "github.com/jonbodner/orchestrion/instrument", module: "github.com/jonbodner/orchestrion", want: false},
+		{pkgPath: "example.com/shared/db", module: "example.com/pkg", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pkgPath, func(t *testing.T) {
+			got, err := shouldInstrument(tt.pkgPath, ".", Options{Module: tt.module, Dependencies: []string{"example.com/shared"}})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestShouldInstrumentDirs(t *testing.T) {
+	t.Setenv("GOROOT", "/usr/local/go")
+	t.Setenv("GOMODCACHE", "/home/user/go/pkg/mod")
+	var tests = []struct {
+		dir  string
+		want bool
+	}{
+		{dir: "/src/app/api", want: true},
+		{dir: "/usr/local/go/src/net/http", want: false},
+		{dir: "/home/user/go/pkg/mod/github.com/gorilla/mux@v1.8.0", want: false},
+		{dir: "/src/app/vendor/github.com/gorilla/mux", want: false},
+		{dir: "/usr/local/gopher", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			got, err := shouldInstrument("example.com/app", tt.dir, Options{})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestIsTool(t *testing.T) {
+	require.True(t, IsTool("/usr/local/go/pkg/tool/linux_amd64/compile"))
+	require.True(t, IsTool("/usr/local/go/pkg/tool/linux_amd64/link"))
+	require.False(t, IsTool("/usr/local/go/bin/go"))
+	require.False(t, IsTool("./"))
+	require.False(t, IsTool("pkg/tool/linux_amd64/compile"))
+}
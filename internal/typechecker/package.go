@@ -0,0 +1,302 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2023-present Datadog, Inc.
+
+package typechecker
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Package describes the Go package a source file belongs to.
+// Check uses it to type check a file along with the other files of its package,
+// resolving imports through Importer instead of the default export data lookup.
+// The package is type checked once, and the result is shared by its files.
+type Package struct {
+	// Path is the import path of the package.
+	Path string
+	// Files holds the absolute names of all the Go files of the package.
+	Files []string
+	// Importer resolves the imports of the package.
+	Importer types.Importer
+
+	// once guards the type checking of the package, see check.
+	once  sync.Once
+	fset  *token.FileSet
+	types *types.Package
+	info  *types.Info
+	// syntax holds the syntax trees of the files type checked, and sources their
+	// sources, by name.
+	syntax  []*ast.File
+	files   map[string]*ast.File
+	sources map[string][]byte
+}
+
+// check type checks the files of the package, the first time it is called.
+func (p *Package) check() {
+	p.once.Do(func() {
+		p.fset = token.NewFileSet()
+		p.info = newInfo()
+		p.files = make(map[string]*ast.File, len(p.Files))
+		p.sources = make(map[string][]byte, len(p.Files))
+		for _, name := range p.Files {
+			src, err := os.ReadFile(name)
+			if err != nil {
+				continue
+			}
+			// the comments are kept, so that the trees match those of the files checked
+			file, err := parser.ParseFile(p.fset, name, src, parser.ParseComments)
+			if err != nil {
+				continue
+			}
+			p.syntax = append(p.syntax, file)
+			p.files[name], p.sources[name] = file, src
+		}
+		conf := &types.Config{
+			Importer: p.Importer,
+			Error:    func(err error) { /* ignore type check errors */ },
+		}
+		p.types, _ = conf.Check(p.Path, p.fset, p.syntax, p.info)
+	})
+}
+
+const loadMode = packages.NeedName |
+	packages.NeedFiles |
+	packages.NeedImports |
+	packages.NeedDeps |
+	packages.NeedExportFile
+
+// registry maps absolute file names to the package they belong to.
+var registry = struct {
+	sync.Mutex
+	files map[string]*Package
+	// dirs records the directories for which a load was attempted.
+	dirs map[string]bool
+}{
+	files: make(map[string]*Package),
+	dirs:  make(map[string]bool),
+}
+
+// Build describes the build a package is loaded for: its target platform and build
+// tags. The empty fields are those of the environment.
+type Build struct {
+	GOOS   string
+	GOARCH string
+	Tags   []string
+}
+
+// Config returns the configuration loading the packages of dir for b.
+// The test files are loaded too, with the test variants of the packages.
+func (b Build) Config(dir string) *packages.Config {
+	cfg := &packages.Config{Mode: loadMode, Dir: dir, Tests: true}
+	if b.GOOS != "" || b.GOARCH != "" {
+		cfg.Env = os.Environ()
+		if b.GOOS != "" {
+			cfg.Env = append(cfg.Env, "GOOS="+b.GOOS)
+		}
+		if b.GOARCH != "" {
+			cfg.Env = append(cfg.Env, "GOARCH="+b.GOARCH)
+		}
+	}
+	if len(b.Tags) > 0 {
+		cfg.BuildFlags = []string{"-tags=" + strings.Join(b.Tags, ",")}
+	}
+	return cfg
+}
+
+// Load loads the packages matching patterns, relative to dir, with all their
+// module dependencies, so that later calls to Check on files of those packages
+// are type checked against the whole package.
+func Load(dir string, patterns ...string) error {
+	return LoadBuild(Build{}, dir, patterns...)
+}
+
+// LoadBuild loads the packages matching patterns like Load, for the build b.
+// The files already loaded keep their package: a file belonging to several
+// builds is type checked along with the files of the first one loaded.
+func LoadBuild(b Build, dir string, patterns ...string) error {
+	pkgs, err := packages.Load(b.Config(dir), patterns...)
+	if err != nil {
+		return fmt.Errorf("error loading packages in %s: %w", dir, err)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	register(pkgs)
+	return nil
+}
+
+// Register associates files with pkg.
+func Register(pkg *Package) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, f := range pkg.Files {
+		registry.files[f] = pkg
+	}
+}
+
+// register records the packages returned by a single load. They share
+// an importer reading the export data of their dependencies, so that
+// every type is only imported once.
+// The test variants of the packages, e.g. "example.com/pkg [example.com/pkg.test]",
+// import the test variants of their dependencies instead: they have their own
+// importer. They are registered last, so that only their test files belong to them.
+func register(pkgs []*packages.Package) {
+	var plain, variants []*packages.Package
+	for _, pkg := range pkgs {
+		switch {
+		case strings.HasSuffix(pkg.ID, ".test"):
+			// the generated main package of the tests
+		case strings.Contains(pkg.ID, " ["):
+			variants = append(variants, pkg)
+		default:
+			plain = append(plain, pkg)
+		}
+	}
+	imp := ExportImporter(exportsOf(plain))
+	for _, pkg := range plain {
+		registerPackage(pkg, imp)
+	}
+	for _, pkg := range variants {
+		registerPackage(pkg, ExportImporter(exportsOf([]*packages.Package{pkg})))
+	}
+}
+
+// exportsOf returns the export data files of pkgs and of their dependencies, by import path.
+func exportsOf(pkgs []*packages.Package) map[string]string {
+	exports := make(map[string]string)
+	packages.Visit(pkgs, nil, func(p *packages.Package) {
+		if p.ExportFile != "" {
+			exports[p.PkgPath] = p.ExportFile
+		}
+		for path, imp := range p.Imports {
+			if imp.ExportFile != "" {
+				exports[path] = imp.ExportFile
+			}
+		}
+	})
+	return exports
+}
+
+// registerPackage associates the files of pkg that don't belong to a package yet
+// with it, resolving its imports with imp.
+func registerPackage(pkg *packages.Package, imp types.Importer) {
+	if len(pkg.GoFiles) == 0 {
+		return
+	}
+	p := &Package{
+		Path:     pkg.PkgPath,
+		Files:    pkg.GoFiles,
+		Importer: imp,
+	}
+	for _, f := range pkg.GoFiles {
+		if _, ok := registry.files[f]; !ok {
+			registry.files[f] = p
+		}
+	}
+	registry.dirs[filepath.Dir(pkg.GoFiles[0])] = true
+}
+
+// ExportImporter returns an importer reading the export data files listed in
+// exports, keyed by import path. Imports that are not listed fall back to the
+// default importer.
+func ExportImporter(exports map[string]string) types.Importer {
+	fallback := importer.Default()
+	gc := importer.ForCompiler(token.NewFileSet(), "gc", func(path string) (io.ReadCloser, error) {
+		return os.Open(exports[path])
+	})
+	return importerFunc(func(path string) (*types.Package, error) {
+		if _, ok := exports[path]; !ok {
+			return fallback.Import(path)
+		}
+		return gc.Import(path)
+	})
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) {
+	return f(path)
+}
+
+// packageOf returns the package of the file name, loading the package of its
+// directory when it hasn't been loaded yet. It returns nil when name is not a
+// file on disk or doesn't belong to a loadable package.
+func packageOf(name string) *Package {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil
+	}
+	if fi, err := os.Stat(abs); err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if pkg, ok := registry.files[abs]; ok {
+		return pkg
+	}
+	dir := filepath.Dir(abs)
+	if registry.dirs[dir] {
+		return nil
+	}
+	registry.dirs[dir] = true
+	pkgs, err := packages.Load(Build{}.Config(dir), ".")
+	if err != nil {
+		return nil
+	}
+	register(pkgs)
+	return registry.files[abs]
+}
+
+// loaded returns the packages loaded so far, in no particular order.
+func loaded() []*Package {
+	registry.Lock()
+	defer registry.Unlock()
+	seen := make(map[*Package]bool)
+	var out []*Package
+	for _, pkg := range registry.files {
+		if !seen[pkg] {
+			seen[pkg] = true
+			out = append(out, pkg)
+		}
+	}
+	return out
+}
+
+// PackagePath returns the import path of the package of the file name, or an empty
+// string when it doesn't belong to a loadable package.
+func PackagePath(name string) string {
+	if pkg := packageOf(name); pkg != nil {
+		return pkg.Path
+	}
+	return ""
+}
+
+// siblings parses the files of pkg other than name that declare the package pkgName.
+func siblings(pkg *Package, name string, pkgName string, fset *token.FileSet) []*ast.File {
+	abs, _ := filepath.Abs(name)
+	var out []*ast.File
+	for _, f := range pkg.Files {
+		if f == abs {
+			continue
+		}
+		file, err := parser.ParseFile(fset, f, nil, parser.ParseComments)
+		if err != nil || file.Name.Name != pkgName {
+			continue
+		}
+		out = append(out, file)
+	}
+	return out
+}
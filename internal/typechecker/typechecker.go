@@ -6,10 +6,15 @@
 package typechecker
 
 import (
+	"bytes"
+	"fmt"
 	"go/ast"
 	"go/importer"
 	"go/token"
 	"go/types"
+	"path/filepath"
+	"reflect"
+	"strings"
 
 	"github.com/dave/dst"
 	"github.com/dave/dst/decorator"
@@ -19,30 +24,99 @@ import (
 // The decorator keeps the mapping between ast.Node and dst.Node while go/types extracts the types.
 // Call check() after instanciation and before calling ofType() or typeOf().
 type TypeChecker struct {
-	dec  *decorator.Decorator
-	info *types.Info
+	dec   *decorator.Decorator
+	info  *types.Info
+	pkg   *types.Package
+	files []*ast.File
+	// exprs maps the expressions of the file checked to those of the syntax tree
+	// of its package, when the result of the type checking of the package is used.
+	exprs map[ast.Expr]ast.Expr
 }
 
 // newTypeChecker constructs a typeChecker.
 func New(dec *decorator.Decorator) *TypeChecker {
 	return &TypeChecker{
-		dec: dec,
-		info: &types.Info{
-			Defs:  make(map[*ast.Ident]types.Object),
-			Uses:  make(map[*ast.Ident]types.Object),
-			Types: make(map[ast.Expr]types.TypeAndValue),
-		},
+		dec:  dec,
+		info: newInfo(),
 	}
 }
 
-// check analyses a target file and stores object types.
+func newInfo() *types.Info {
+	return &types.Info{
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+		Types: make(map[ast.Expr]types.TypeAndValue),
+	}
+}
+
+// check analyses a target file, with the source src, and stores object types.
+// When the file belongs to a package on disk, the types of the package are used,
+// so that types declared in sibling files and module dependencies are resolved:
+// the package is type checked once, and shared by its files. A file whose source
+// differs from the one on disk is checked along with the other files of the package.
+// Otherwise it is checked in isolation.
 // It must be called at least once before calling ofType or typeOf.
-func (tc *TypeChecker) Check(name string, fset *token.FileSet, file *ast.File) {
+func (tc *TypeChecker) Check(name string, src []byte, fset *token.FileSet, file *ast.File) {
+	pkg := packageOf(name)
+	if pkg == nil {
+		tc.check(name, importer.Default(), fset, []*ast.File{file})
+		return
+	}
+	pkg.check()
+	abs, _ := filepath.Abs(name)
+	if shared, ok := pkg.files[abs]; ok && bytes.Equal(pkg.sources[abs], src) {
+		if exprs, ok := matchExprs(file, shared); ok {
+			tc.info, tc.pkg, tc.files, tc.exprs = pkg.info, pkg.types, pkg.syntax, exprs
+			return
+		}
+	}
+	tc.check(pkg.Path, pkg.Importer, fset, append([]*ast.File{file}, siblings(pkg, name, file.Name.Name, fset)...))
+}
+
+// check type checks files as the package path.
+func (tc *TypeChecker) check(path string, imp types.Importer, fset *token.FileSet, files []*ast.File) {
 	conf := &types.Config{
-		Importer: importer.Default(),
+		Importer: imp,
 		Error:    func(err error) { /* ignore type check errors */ },
 	}
-	_, _ = conf.Check(name, fset, []*ast.File{file}, tc.info)
+	tc.pkg, _ = conf.Check(path, fset, files, tc.info)
+	tc.files = files
+}
+
+// matchExprs maps the expressions of file to those of shared, parsed from the same
+// source: their nodes are visited in the same order. It reports whether they match.
+func matchExprs(file, shared *ast.File) (map[ast.Expr]ast.Expr, bool) {
+	var nodes, sharedNodes []ast.Node
+	ast.Inspect(file, func(n ast.Node) bool {
+		nodes = append(nodes, n)
+		return true
+	})
+	ast.Inspect(shared, func(n ast.Node) bool {
+		sharedNodes = append(sharedNodes, n)
+		return true
+	})
+	if len(nodes) != len(sharedNodes) {
+		return nil, false
+	}
+	exprs := make(map[ast.Expr]ast.Expr)
+	for i, n := range nodes {
+		if reflect.TypeOf(n) != reflect.TypeOf(sharedNodes[i]) {
+			return nil, false
+		}
+		if expr, ok := n.(ast.Expr); ok {
+			exprs[expr] = sharedNodes[i].(ast.Expr)
+		}
+	}
+	return exprs, true
+}
+
+// astExpr returns the expression type checked for expr, if any.
+func (tc TypeChecker) astExpr(expr dst.Expr) (ast.Expr, bool) {
+	astExpr, ok := tc.dec.Ast.Nodes[expr].(ast.Expr)
+	if ok && tc.exprs != nil {
+		astExpr, ok = tc.exprs[astExpr]
+	}
+	return astExpr, ok
 }
 
 // ofType checks the type of an expression.
@@ -52,11 +126,141 @@ func (tc TypeChecker) OfType(expr dst.Expr, t string) bool {
 
 // typeOf returns the type of an expression.
 func (tc TypeChecker) TypeOf(expr dst.Expr) string {
-	astExpr := tc.dec.Ast.Nodes[expr].(ast.Expr)
+	astExpr, ok := tc.astExpr(expr)
+	if !ok {
+		// the expression was added by the instrumentation
+		return ""
+	}
 	to := tc.info.TypeOf(astExpr)
 	if to == nil {
 		// this was almost certainly an underscore "_"
 		return ""
 	}
-	return to.String()
+	return unalias(to).String()
+}
+
+// CheckFields checks that the fields can be selected in turn from the value of expr,
+// e.g. the fields User and ID for req.User.ID.
+// It returns nil when the type of expr is unknown.
+func (tc TypeChecker) CheckFields(expr dst.Expr, fields []string) error {
+	astExpr, ok := tc.astExpr(expr)
+	if !ok {
+		return nil
+	}
+	t := tc.info.TypeOf(astExpr)
+	if t == nil {
+		return nil
+	}
+	for _, name := range fields {
+		obj, _, _ := types.LookupFieldOrMethod(t, true, tc.pkg, name)
+		field, ok := obj.(*types.Var)
+		if !ok {
+			return fmt.Errorf("%s has no field %s", unalias(t), name)
+		}
+		t = field.Type()
+	}
+	return nil
+}
+
+// Implements reports whether the type of expr, or a pointer to it, implements the
+// interface iface, e.g. net/http.Handler. The package of iface must be imported.
+func (tc TypeChecker) Implements(expr dst.Expr, iface string) bool {
+	astExpr, ok := tc.astExpr(expr)
+	if !ok || tc.pkg == nil {
+		return false
+	}
+	t := tc.info.TypeOf(astExpr)
+	i := strings.LastIndex(iface, ".")
+	if t == nil || i < 0 {
+		return false
+	}
+	for _, imp := range tc.pkg.Imports() {
+		if imp.Path() != iface[:i] {
+			continue
+		}
+		obj := imp.Scope().Lookup(iface[i+1:])
+		if obj == nil {
+			return false
+		}
+		it, ok := obj.Type().Underlying().(*types.Interface)
+		return ok && (types.Implements(t, it) || types.Implements(types.NewPointer(t), it))
+	}
+	return false
+}
+
+// ArgTypes returns the types of the argument arg of the calls to the functions fns,
+// e.g. net/http.Handle, made anywhere in the package or in the other packages loaded,
+// e.g. by Load: a handler declared in a package is often registered in another one.
+func (tc TypeChecker) ArgTypes(arg int, fns ...string) []string {
+	out := argTypes(tc.info, tc.files, arg, fns)
+	for _, pkg := range loaded() {
+		if tc.pkg != nil && pkg.Path == tc.pkg.Path() {
+			// the package of the file checked, whose source may differ from the one on disk
+			continue
+		}
+		pkg.check()
+		out = append(out, argTypes(pkg.info, pkg.syntax, arg, fns)...)
+	}
+	return out
+}
+
+// argTypes returns the types of the argument arg of the calls to the functions fns
+// made in files, type checked with info.
+func argTypes(info *types.Info, files []*ast.File, arg int, fns []string) []string {
+	var out []string
+	for _, file := range files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) <= arg {
+				return true
+			}
+			name := funcName(info, call.Fun)
+			for _, fn := range fns {
+				if name == fn {
+					if t := info.TypeOf(call.Args[arg]); t != nil {
+						out = append(out, unalias(t).String())
+					}
+				}
+			}
+			return true
+		})
+	}
+	return out
+}
+
+// funcName returns the full name of the function fun, e.g. net/http.Handle.
+// The functions of the packages that couldn't be imported are named after their
+// import path.
+func funcName(info *types.Info, fun ast.Expr) string {
+	switch fun := fun.(type) {
+	case *ast.Ident:
+		if f, ok := info.Uses[fun].(*types.Func); ok && f.Pkg() != nil {
+			return f.Pkg().Path() + "." + f.Name()
+		}
+	case *ast.SelectorExpr:
+		if f, ok := info.Uses[fun.Sel].(*types.Func); ok && f.Pkg() != nil {
+			return f.Pkg().Path() + "." + f.Name()
+		}
+		if x, ok := fun.X.(*ast.Ident); ok {
+			if pkg, ok := info.Uses[x].(*types.PkgName); ok {
+				return pkg.Imported().Path() + "." + fun.Sel.Name
+			}
+		}
+	}
+	return ""
+}
+
+// unalias replaces the type aliases in t by the types they stand for.
+// Recent versions of go/types represent aliases explicitly, which would
+// otherwise hide e.g. a *net/http.Request behind the name of its alias.
+func unalias(t types.Type) types.Type {
+	switch tt := t.(type) {
+	case interface{ Rhs() types.Type }:
+		return unalias(tt.Rhs())
+	case *types.Pointer:
+		return types.NewPointer(unalias(tt.Elem()))
+	case *types.Slice:
+		return types.NewSlice(unalias(tt.Elem()))
+	}
+	return t
 }
@@ -8,6 +8,8 @@ package typechecker
 import (
 	"go/parser"
 	"go/token"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -55,7 +57,7 @@ func TestTypeChecker(t *testing.T) {
 	require.NoError(t, err)
 
 	tc := New(dec)
-	tc.Check(name, fset, astFile)
+	tc.Check(name, []byte(code), fset, astFile)
 
 	checks := 0
 	dst.Inspect(f, func(n dst.Node) bool {
@@ -68,3 +70,205 @@ func TestTypeChecker(t *testing.T) {
 	})
 	require.GreaterOrEqual(t, checks, len(expected))
 }
+
+func TestTypeCheckerPackage(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/pkg\n\ngo 1.19\n",
+		"types.go": `package pkg
+
+import "net/http"
+
+type handler struct{}
+
+type request = http.Request
+`,
+		"main.go": `package pkg
+
+import "net/http"
+
+func serve(w http.ResponseWriter, r *request) {
+	var h handler
+	client := http.DefaultClient
+}
+`,
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	require.NoError(t, Load(dir, "./..."))
+
+	expected := map[string]string{
+		"r":      "*net/http.Request",
+		"h":      "example.com/pkg.handler",
+		"client": "*net/http.Client",
+	}
+	name := filepath.Join(dir, "main.go")
+	fset := token.NewFileSet()
+	astFile, err := parser.ParseFile(fset, name, files["main.go"], parser.ParseComments)
+	require.NoError(t, err)
+
+	dec := decorator.NewDecoratorWithImports(fset, name, goast.New())
+	f, err := dec.DecorateFile(astFile)
+	require.NoError(t, err)
+
+	tc := New(dec)
+	tc.Check(name, []byte(files["main.go"]), fset, astFile)
+
+	checks := 0
+	dst.Inspect(f, func(n dst.Node) bool {
+		if ident, ok := n.(*dst.Ident); ok && expected[ident.Name] != "" {
+			checks++
+			require.Equal(t, expected[ident.Name], tc.TypeOf(ident))
+		}
+		return true
+	})
+	require.GreaterOrEqual(t, checks, len(expected))
+}
+
+func TestHandlers(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/pkg\n\ngo 1.19\n",
+		"register.go": `package pkg
+
+import "net/http"
+
+func register() {
+	http.Handle("/api", &api{})
+}
+`,
+		"api.go": `package pkg
+
+import "net/http"
+
+type api struct{}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {}
+
+type other struct{}
+`,
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	require.NoError(t, Load(dir, "./..."))
+
+	name := filepath.Join(dir, "api.go")
+	fset := token.NewFileSet()
+	astFile, err := parser.ParseFile(fset, name, files["api.go"], parser.ParseComments)
+	require.NoError(t, err)
+
+	dec := decorator.NewDecoratorWithImports(fset, name, goast.New())
+	f, err := dec.DecorateFile(astFile)
+	require.NoError(t, err)
+
+	tc := New(dec)
+	tc.Check(name, []byte(files["api.go"]), fset, astFile)
+
+	implements := map[string]bool{}
+	dst.Inspect(f, func(n dst.Node) bool {
+		if spec, ok := n.(*dst.TypeSpec); ok {
+			implements[spec.Name.Name] = tc.Implements(spec.Name, "net/http.Handler")
+		}
+		return true
+	})
+	require.Equal(t, map[string]bool{"api": true, "other": false}, implements)
+	require.Equal(t, []string{"*example.com/pkg.api"}, tc.ArgTypes(1, "net/http.Handle"))
+}
+
+func TestTypeCheckerShared(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/pkg\n\ngo 1.19\n",
+		"pkg.go": `package pkg
+
+import "net/http"
+
+type handler struct{}
+
+type Client struct{ http.Client }
+
+func newClient() *Client {
+	c := &Client{}
+	return c
+}
+`,
+		"other.go": `package pkg
+
+func other() {
+	var h handler
+	_ = h
+}
+`,
+		"pkg_test.go": `package pkg
+
+import "testing"
+
+func TestHandler(t *testing.T) {
+	var h handler
+	c := newClient()
+	_, _ = h, c
+}
+`,
+		"export_test.go": `package pkg
+
+var NewClient = newClient
+`,
+		"pkg_ext_test.go": `package pkg_test
+
+import (
+	"testing"
+
+	"example.com/pkg"
+)
+
+func TestClient(t *testing.T) {
+	client := pkg.NewClient()
+	_ = client
+}
+`,
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	require.NoError(t, Load(dir, "./..."))
+
+	check := func(name string, expected map[string]string) *TypeChecker {
+		name = filepath.Join(dir, name)
+		src := []byte(files[filepath.Base(name)])
+		fset := token.NewFileSet()
+		astFile, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+		require.NoError(t, err)
+
+		dec := decorator.NewDecoratorWithImports(fset, name, goast.New())
+		f, err := dec.DecorateFile(astFile)
+		require.NoError(t, err)
+
+		tc := New(dec)
+		tc.Check(name, src, fset, astFile)
+
+		checks := 0
+		dst.Inspect(f, func(n dst.Node) bool {
+			if ident, ok := n.(*dst.Ident); ok && expected[ident.Name] != "" {
+				checks++
+				require.Equal(t, expected[ident.Name], tc.TypeOf(ident), ident.Name)
+			}
+			return true
+		})
+		require.GreaterOrEqual(t, checks, len(expected))
+		return tc
+	}
+
+	// the files of a package share the result of its type checking
+	first := check("pkg.go", map[string]string{"c": "*example.com/pkg.Client"})
+	second := check("other.go", map[string]string{"h": "example.com/pkg.handler"})
+	require.Same(t, first.pkg, second.pkg)
+
+	// the test files are checked with their test variant
+	check("pkg_test.go", map[string]string{
+		"h": "example.com/pkg.handler",
+		"c": "*example.com/pkg.Client",
+	})
+	check("pkg_ext_test.go", map[string]string{"client": "*example.com/pkg.Client"})
+}
@@ -6,6 +6,8 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -14,41 +16,89 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/jonbodner/orchestrion/internal/check"
 	"github.com/jonbodner/orchestrion/internal/config"
+	"github.com/jonbodner/orchestrion/internal/diff"
 	"github.com/jonbodner/orchestrion/internal/instrument"
+	"github.com/jonbodner/orchestrion/internal/rules"
+	"github.com/jonbodner/orchestrion/internal/toolexec"
 )
 
 func main() {
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
-		fmt.Fprint(w, "usage: orchestrion [options] [path]\n")
+		fmt.Fprint(w, "usage: orchestrion [options] [paths or packages]\n")
+		fmt.Fprint(w, "       orchestrion [options] go build|test|run|install|vet [go flags] [packages]\n")
+		fmt.Fprint(w, "       orchestrion [options] upgrade [paths or packages]\n")
+		fmt.Fprint(w, "       orchestrion [options] check [-format text|json|sarif] [paths or packages]\n")
 		fmt.Fprint(w, "example: orchestrion -w ./\n")
+		fmt.Fprint(w, "example: orchestrion -w ./cmd/... example.com/app/internal/api\n")
+		fmt.Fprint(w, "example: orchestrion go test ./...\n")
+		fmt.Fprint(w, "example: orchestrion -w upgrade ./\n")
+		fmt.Fprint(w, "example: orchestrion check -format sarif ./... > orchestrion.sarif\n")
 		fmt.Fprint(w, "options:\n")
 		flag.PrintDefaults()
 	}
 	var write bool
+	var list bool
+	var showDiff bool
 	var remove bool
 	var tool bool
 	var httpMode string
 	var target string
+	var rulesFile string
+	var module string
+	var verbose bool
+	var deps string
+	var panics bool
+	var defaultClient bool
+	var prefix string
+	var configFile string
+	var include, exclude, includeFiles, excludeFiles string
+	var goos, goarch, tags string
+	var format string
 	flag.BoolVar(&remove, "rm", false, "remove all instrumentation from the package")
 	flag.BoolVar(&write, "w", false, "if set, overwrite the current file with the instrumented file")
-	flag.BoolVar(&tool, "t", false, "if set, run in toolexec mode")
-	flag.StringVar(&httpMode, "httpmode", "wrap", "set the http instrumentation mode: wrap (default) or report")
+	flag.BoolVar(&list, "l", false, "list the files whose instrumentation would change, and exit with status 1 if there are any, unless -w is set")
+	flag.BoolVar(&showDiff, "d", false, "print the diffs of the files whose instrumentation would change, and exit with status 1 if there are any, unless -w is set")
+	flag.BoolVar(&tool, "t", false, "if set, run in toolexec mode: orchestrion -t [options] tool [args]")
+	flag.StringVar(&module, "module", "", "in toolexec mode, only instrument the packages of this module")
+	flag.StringVar(&deps, "deps", "", "in toolexec mode, comma-separated paths of the dependency modules to instrument too (std for the standard library)")
+	flag.BoolVar(&verbose, "v", false, "in toolexec mode, log to stderr")
+	flag.StringVar(&httpMode, "httpmode", "wrap", "set the http instrumentation mode: wrap (default) or report (in toolexec mode, report does not see the handlers wrapped in other packages, which report twice)")
 	flag.StringVar(&target, "target", "console", "set the target instrumentation type: console (default), dd, or otel")
+	flag.StringVar(&rulesFile, "rules", "", "if set, load additional injection rules from this YAML file")
+	flag.BoolVar(&panics, "panics", false, "if set, instrumented handlers and spans report panics as errors before panicking again")
+	flag.BoolVar(&defaultClient, "defaultclient", false, "in wrap mode, if set, main wraps http.DefaultClient so that http.Get and the like are traced")
+	flag.StringVar(&prefix, "prefix", "dd", "set the prefix of the directives written, e.g. orchestrion for //orchestrion:span (dd and orchestrion are always recognized)")
+	flag.StringVar(&include, "include", "", "comma-separated patterns of the import paths of the packages to instrument, e.g. example.com/app/...")
+	flag.StringVar(&exclude, "exclude", "", "comma-separated patterns of the import paths of the packages not to instrument")
+	flag.StringVar(&includeFiles, "includefiles", "", "comma-separated globs of the files to instrument, e.g. api/*.go")
+	flag.StringVar(&excludeFiles, "excludefiles", "", "comma-separated globs of the files not to instrument, e.g. *_test.go")
+	flag.StringVar(&goos, "goos", "", "type check the files for this GOOS (default $GOOS); the files of other builds are checked with their own")
+	flag.StringVar(&goarch, "goarch", "", "type check the files for this GOARCH (default $GOARCH)")
+	flag.StringVar(&tags, "tags", "", "comma-separated build tags the files are type checked with")
+	flag.StringVar(&format, "format", "text", "in check mode, set the format of the diagnostics: text (default), json, or sarif")
+	flag.StringVar(&configFile, "config", "", "load the configuration from this file instead of the "+config.FileName+" file at the root of the module")
 	flag.Parse()
 	if len(flag.Args()) == 0 {
 		return
 	}
+	// pending records whether some files change, with -l and -d.
+	pending := false
+	// With -l and -d, only the files that change are reported, and only them are written with -w.
+	quiet := list || showDiff
 	output := func(fullName string, out io.Reader) {
 		fmt.Printf("%s:\n", fullName)
 		// write the output
 		txt, _ := io.ReadAll(out)
 		fmt.Println(string(txt))
 	}
-	if write || tool {
+	if write {
 		output = func(fullName string, out io.Reader) {
-			fmt.Printf("overwriting %s:\n", fullName)
+			if !quiet {
+				fmt.Printf("overwriting %s:\n", fullName)
+			}
 			// write the output
 			txt, _ := io.ReadAll(out)
 			err := os.WriteFile(fullName, txt, 0644)
@@ -57,90 +107,239 @@ func main() {
 			}
 		}
 	}
-	conf := config.Config{HTTPMode: httpMode, Instrumentation: target}
+	if quiet {
+		writeFile := output
+		output = func(fullName string, out io.Reader) {
+			txt, _ := io.ReadAll(out)
+			orig, err := os.ReadFile(fullName)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Reading file %s: %v\n", fullName, err)
+				return
+			}
+			if bytes.Equal(orig, txt) {
+				return
+			}
+			pending = true
+			if list {
+				fmt.Println(fullName)
+			}
+			if showDiff {
+				os.Stdout.Write(diff.Unified(fullName+".orig", fullName, orig, txt))
+			}
+			if write {
+				writeFile(fullName, bytes.NewReader(txt))
+			}
+		}
+	}
+	var conf config.Config
+	if configFile == "" {
+		configFile, _ = config.Find(".")
+	}
+	if configFile != "" {
+		var err error
+		conf, err = config.Load(configFile)
+		if err != nil {
+			fmt.Printf("Config error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	// The flags set on the command line override the configuration file.
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["httpmode"] || conf.HTTPMode == "" {
+		conf.HTTPMode = httpMode
+	}
+	if set["target"] || conf.Instrumentation == "" {
+		conf.Instrumentation = target
+	}
+	if set["prefix"] || conf.Prefix == "" {
+		conf.Prefix = prefix
+	}
+	if set["panics"] {
+		conf.RecordPanics = panics
+	}
+	if set["defaultclient"] {
+		conf.WrapDefaultClient = defaultClient
+	}
+	if goos != "" {
+		conf.GOOS = goos
+	}
+	if goarch != "" {
+		conf.GOARCH = goarch
+	}
+	conf.BuildTags = append(conf.BuildTags, splitList(tags)...)
+	conf.Include = append(conf.Include, splitList(include)...)
+	conf.Exclude = append(conf.Exclude, splitList(exclude)...)
+	conf.IncludeFiles = append(conf.IncludeFiles, splitList(includeFiles)...)
+	conf.ExcludeFiles = append(conf.ExcludeFiles, splitList(excludeFiles)...)
+	if rulesFile != "" {
+		f, err := rules.Load(rulesFile)
+		if err != nil {
+			fmt.Printf("Rules error: %v\n", err)
+			os.Exit(1)
+		}
+		conf.Rules = append(conf.Rules, f.Rules...)
+		conf.Contexts = append(conf.Contexts, f.Contexts...)
+	}
 	if err := conf.Validate(); err != nil {
 		fmt.Printf("Config error: %v\n", err)
 		os.Exit(1)
 	}
+	// "go build -toolexec orchestrion" runs orchestrion with the path of a go tool.
+	if toolexec.IsTool(flag.Arg(0)) {
+		tool = true
+	}
+	if flag.Arg(0) == "go" {
+		err := toolexec.Go(flag.Args()[1:], configFlags(configFile), toolexec.Options{Module: module, Dependencies: splitList(deps), Verbose: verbose})
+		if err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			fmt.Fprintf(os.Stderr, "orchestrion go: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if tool {
-		path := os.Args[2]
-		err := runToolexecMode(path, conf, output)
+		args := flag.Args()
+		err := toolexec.Run(args[0], args[1:], conf, toolexec.Options{Module: module, Dependencies: splitList(deps), Verbose: verbose})
 		if err != nil {
-			fmt.Printf("toolexec error: %v\n", err)
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			fmt.Fprintf(os.Stderr, "toolexec error: %v\n", err)
 			os.Exit(1)
 		}
 		return
 	}
-	for _, v := range flag.Args() {
+	paths := flag.Args()
+	upgrade := flag.Arg(0) == "upgrade"
+	checking := flag.Arg(0) == "check"
+	if upgrade || checking {
+		paths = paths[1:]
+	}
+	if checking {
+		// the flags of the check command follow it
+		fs := flag.NewFlagSet("check", flag.ExitOnError)
+		fs.StringVar(&format, "format", format, "set the format of the diagnostics: text (default), json, or sarif")
+		fs.Parse(paths)
+		paths = fs.Args()
+		quiet = true
+	}
+	writeDiagnostics, ok := map[string]func(io.Writer, []check.Diagnostic) error{
+		"text":  check.WriteText,
+		"json":  check.WriteJSON,
+		"sarif": writeSARIF,
+	}[format]
+	if !ok {
+		fmt.Printf("Invalid format %q: must be text, json, or sarif\n", format)
+		os.Exit(1)
+	}
+	// The progress messages are left out of the lists and diffs.
+	progress := func(format string, a ...any) {
+		if !quiet {
+			fmt.Printf(format, a...)
+		}
+	}
+	args := make([]string, 0, len(paths))
+	for _, v := range paths {
+		if instrument.IsPattern(v) {
+			progress("Scanning Packages %s\n", v)
+			args = append(args, v)
+			continue
+		}
 		p, err := filepath.Abs(v)
 		if err != nil {
 			fmt.Printf("Sanitizing path (%s) failed: %v\n", v, err)
 			continue
 		}
-		fmt.Printf("Scanning Package %s\n", p)
-		processor := instrument.InstrumentFile
-		if remove {
-			fmt.Printf("Removing Orchestrion instrumentation.\n")
-			processor = instrument.UninstrumentFile
+		progress("Scanning Package %s\n", p)
+		args = append(args, p)
+	}
+	processor := instrument.InstrumentFile
+	// diagnostics records the code that is not instrumented, in check mode.
+	var diagnostics []check.Diagnostic
+	if checking {
+		processor = func(name string, r io.Reader, conf config.Config) (io.Reader, error) {
+			src, err := io.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			ds, err := check.File(name, src, conf)
+			diagnostics = append(diagnostics, ds...)
+			return nil, err
 		}
-		err = instrument.ProcessPackage(p, processor, output, conf)
-		if err != nil {
-			fmt.Printf("Failed to scan: %v\n", err)
+	} else if remove {
+		progress("Removing Orchestrion instrumentation.\n")
+		processor = instrument.UninstrumentFile
+	} else if upgrade {
+		progress("Upgrading Orchestrion instrumentation.\n")
+		processor = instrument.UpgradeFile
+	}
+	if err := instrument.ProcessPatterns(args, processor, output, conf); err != nil {
+		fmt.Printf("Failed to scan: %v\n", err)
+		os.Exit(1)
+	}
+	if checking {
+		if err := writeDiagnostics(os.Stdout, diagnostics); err != nil {
+			fmt.Fprintf(os.Stderr, "Writing diagnostics: %v\n", err)
+			os.Exit(1)
+		}
+		if len(diagnostics) > 0 {
 			os.Exit(1)
 		}
+		return
+	}
+	if pending && !write {
+		os.Exit(1)
 	}
 }
 
-func runToolexecMode(path string, conf config.Config, output func(fullName string, out io.Reader)) error {
-	tool, args := os.Args[3], os.Args[4:]
-	toolName := filepath.Base(tool)
-	if len(args) > 0 && args[0] == "-V=full" {
-		// We can't alter the version output.
-	} else {
-		fmt.Println(os.Args)
-		if toolName == "compile" {
-			tmpDir, err := os.MkdirTemp("", "orchestrion")
+// writeSARIF writes the diagnostics ds as a SARIF log, with the file names relative
+// to the current directory.
+func writeSARIF(w io.Writer, ds []check.Diagnostic) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	return check.WriteSARIF(w, ds, wd)
+}
+
+// configFlags returns the configuration flags set on the command line, and the
+// configuration file in use, to pass them on to orchestrion in toolexec mode.
+func configFlags(configFile string) []string {
+	var out []string
+	if configFile != "" {
+		name, err := filepath.Abs(configFile)
+		if err != nil {
+			name = configFile
+		}
+		out = append(out, "-config="+name)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "httpmode", "target", "panics", "defaultclient", "prefix", "include", "exclude", "includefiles", "excludefiles":
+			out = append(out, "-"+f.Name+"="+f.Value.String())
+		case "rules":
+			name, err := filepath.Abs(f.Value.String())
 			if err != nil {
-				return err
+				name = f.Value.String()
 			}
-			defer os.RemoveAll(tmpDir)
-			newArgs := make([]string, 0, len(args))
-			for _, v := range args {
-				if strings.HasPrefix(v, path) && strings.HasSuffix(v, ".go") {
-					fmt.Println("modifying:", v)
-
-					otherPath, err := filepath.Abs(v)
+			out = append(out, "-"+f.Name+"="+name)
+		}
+	})
+	return out
+}
 
-					if err != nil {
-						return fmt.Errorf("Sanitizing path (%s) failed: %v\n", v, err)
-					}
-					file, err := os.Open(v)
-					if err != nil {
-						return fmt.Errorf("error opening file: %w", err)
-					}
-					out, err := instrument.InstrumentFile(otherPath, file, conf)
-					file.Close()
-					if err != nil {
-						return fmt.Errorf("error scanning file %s: %w", path, err)
-					}
-					newFileName := tmpDir + string(os.PathSeparator) + filepath.Base(otherPath)
-					if out != nil {
-						output(newFileName, out)
-					}
-					newArgs = append(newArgs, newFileName)
-				} else {
-					newArgs = append(newArgs, v)
-				}
-			}
-			args = newArgs
+// splitList splits a comma-separated list, ignoring empty elements.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
 		}
 	}
-	// Simply run the tool.
-	cmd := exec.Command(tool, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-	return nil
+	return out
 }
@@ -9,8 +9,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-
-	_ "github.com/jonbodner/orchestrion/instrument"
 )
 
 func main() {